@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+)
+
+// requestStats counts directives for the admin /metrics endpoint.
+type requestStats struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	inFlight atomic.Int64
+}
+
+// serveAdmin exposes pprof, metrics and the diagnostics report on the
+// node's own tailnet address only, so operators can inspect a long-running
+// proxy from inside the tailnet without a public endpoint or token.
+func (h *LambdaHandler) serveAdmin(addr string) error {
+	ln, err := h.TSNetServer.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	h.Logger.Sugar().Infof("Admin listener on tailnet address %s", addr)
+	return http.Serve(ln, h.newAdminMux())
+}
+
+func (h *LambdaHandler) newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mountPprof(mux, func(next http.Handler) http.Handler { return next })
+	mux.HandleFunc("/metrics", h.serveMetrics)
+	mux.HandleFunc("/diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.runDiagnostics(r.Context()))
+	})
+	return mux
+}
+
+// mountPprof registers the pprof handlers on mux, each wrapped by wrap.
+func mountPprof(mux *http.ServeMux, wrap func(http.Handler) http.Handler) {
+	mux.Handle("/debug/pprof/", wrap(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", wrap(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", wrap(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", wrap(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", wrap(http.HandlerFunc(pprof.Trace)))
+}
+
+// serveMetrics writes the request counters in Prometheus text format.
+func (h *LambdaHandler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE hass_proxy_requests_total counter\nhass_proxy_requests_total %d\n", h.stats.requests.Load())
+	fmt.Fprintf(w, "# TYPE hass_proxy_errors_total counter\nhass_proxy_errors_total %d\n", h.stats.errors.Load())
+	fmt.Fprintf(w, "# TYPE hass_proxy_in_flight gauge\nhass_proxy_in_flight %d\n", h.stats.inFlight.Load())
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminMux_Metrics(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example"})
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusBadGateway, ""), nil
+	})
+	handler.HandleRequest(context.Background(), discoveryEvent())
+
+	rec := httptest.NewRecorder()
+	handler.newAdminMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "hass_proxy_requests_total 1\n") || !strings.Contains(body, "hass_proxy_errors_total 1\n") {
+		t.Errorf("Unexpected metrics:\n%s", body)
+	}
+
+	// pprof needs no token on the tailnet listener
+	rec = httptest.NewRecorder()
+	handler.newAdminMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected pprof to be served, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Separates the backend name from the Home Assistant endpointId.
+const endpointSeparator = ":"
+
+var errUnknownEndpoint = errors.New("endpoint does not belong to a configured backend")
+
+// backend is one of several Home Assistant instances behind a single skill.
+type backend struct {
+	Name string `json:"name"`
+	upstream
+}
+
+// loadBackends reads BACKENDS_FILE, a JSON array of
+// {"name": ..., "baseUrl": ..., "token": ...}.
+func loadBackends(path string) ([]backend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var backends []backend
+	if err := json.Unmarshal(data, &backends); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, b := range backends {
+		if b.Name == "" || strings.Contains(b.Name, endpointSeparator) || seen[b.Name] {
+			return nil, fmt.Errorf("%s: backend %d needs a unique name without %q", path, i, endpointSeparator)
+		}
+		seen[b.Name] = true
+		backends[i].BaseURL = strings.TrimRight(b.BaseURL, "/")
+		// Keeps BASE_URL failover away from backends
+		backends[i].Tenant = b.Name
+	}
+	return backends, nil
+}
+
+// aggregate presents several instances as one. Discovery is merged with
+// endpointIds prefixed by the backend name, directives for an endpoint go to
+// the backend that owns it, and directives without an endpoint such as
+// AcceptGrant go to every backend.
+func (h *LambdaHandler) aggregate(ctx context.Context, info directiveInfo, event map[string]interface{}) (map[string]interface{}, error) {
+	switch {
+	case info.isDiscovery():
+		return h.aggregateDiscovery(ctx, info, event)
+	case info.EndpointID != "":
+		name, endpointID, _ := strings.Cut(info.EndpointID, endpointSeparator)
+		for _, b := range h.backends {
+			if b.Name != name {
+				continue
+			}
+			response, err := h.dispatch(ctx, info, b.upstream, withEndpointID(event, endpointID))
+			if err != nil {
+				return nil, err
+			}
+			prefixResponseEndpoint(response, name)
+			return response, nil
+		}
+		return nil, errUnknownEndpoint
+	default:
+		results := h.broadcast(ctx, info, event)
+		for _, result := range results {
+			if result.err == nil {
+				return result.response, nil
+			}
+		}
+		return nil, results[0].err
+	}
+}
+
+// aggregateDiscovery fails if any backend does: Alexa treats endpoints
+// missing from a Discover.Response as deleted, while an error keeps the
+// devices it already knows.
+func (h *LambdaHandler) aggregateDiscovery(ctx context.Context, info directiveInfo, event map[string]interface{}) (map[string]interface{}, error) {
+	var merged map[string]interface{}
+	var endpoints []interface{}
+	for i, result := range h.broadcast(ctx, info, event) {
+		if result.err != nil {
+			h.logger(ctx).Sugar().Warnf("Discovery failed on backend %s: %v", h.backends[i].Name, result.err)
+			return nil, result.err
+		}
+		payload := responsePayload(result.response)
+		found, _ := payload["endpoints"].([]interface{})
+		for _, e := range found {
+			if endpoint, ok := e.(map[string]interface{}); ok {
+				if id, ok := endpoint["endpointId"].(string); ok {
+					endpoint["endpointId"] = h.backends[i].Name + endpointSeparator + id
+				}
+			}
+			endpoints = append(endpoints, e)
+		}
+		if merged == nil {
+			merged = result.response
+		}
+	}
+	if payload := responsePayload(merged); payload != nil {
+		payload["endpoints"] = endpoints
+	}
+	return merged, nil
+}
+
+type backendResult struct {
+	response map[string]interface{}
+	err      error
+}
+
+// broadcast sends event to every backend concurrently. Results are in
+// backend order.
+func (h *LambdaHandler) broadcast(ctx context.Context, info directiveInfo, event map[string]interface{}) []backendResult {
+	results := make([]backendResult, len(h.backends))
+	var wg sync.WaitGroup
+	for i, b := range h.backends {
+		wg.Add(1)
+		go func(i int, target upstream) {
+			defer wg.Done()
+			response, err := h.dispatch(ctx, info, target, event)
+			results[i] = backendResult{response: response, err: err}
+		}(i, b.upstream)
+	}
+	wg.Wait()
+	return results
+}
+
+// withEndpointID returns a copy of event addressed to endpointID, leaving
+// the original untouched for recording.
+func withEndpointID(event map[string]interface{}, endpointID string) map[string]interface{} {
+	directive, _ := event["directive"].(map[string]interface{})
+	endpoint, _ := directive["endpoint"].(map[string]interface{})
+
+	endpointCopy := make(map[string]interface{}, len(endpoint))
+	for k, v := range endpoint {
+		endpointCopy[k] = v
+	}
+	endpointCopy["endpointId"] = endpointID
+
+	directiveCopy := make(map[string]interface{}, len(directive))
+	for k, v := range directive {
+		directiveCopy[k] = v
+	}
+	directiveCopy["endpoint"] = endpointCopy
+
+	eventCopy := make(map[string]interface{}, len(event))
+	for k, v := range event {
+		eventCopy[k] = v
+	}
+	eventCopy["directive"] = directiveCopy
+	return eventCopy
+}
+
+// prefixResponseEndpoint restores the backend prefix on the endpoint a
+// response or state report refers to.
+func prefixResponseEndpoint(response map[string]interface{}, name string) {
+	e, _ := response["event"].(map[string]interface{})
+	endpoint, _ := e["endpoint"].(map[string]interface{})
+	if id, ok := endpoint["endpointId"].(string); ok {
+		endpoint["endpointId"] = name + endpointSeparator + id
+	}
+}
+
+func responsePayload(response map[string]interface{}) map[string]interface{} {
+	e, _ := response["event"].(map[string]interface{})
+	payload, _ := e["payload"].(map[string]interface{})
+	return payload
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that discovery is merged and control directives reach their owner
+func TestHandleRequest_Aggregate(t *testing.T) {
+	t.Parallel()
+	backends := filepath.Join(t.TempDir(), "backends.json")
+	os.WriteFile(backends, []byte(`[
+		{"name": "house", "baseUrl": "http://house.example/", "token": "house-token"},
+		{"name": "cabin", "baseUrl": "http://cabin.example", "token": "cabin-token"}
+	]`), 0o600)
+	handler := newTestHandler(t, Config{BackendsFile: backends})
+
+	var controlled string
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		var event map[string]interface{}
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &event)
+		endpoint, _ := event["directive"].(map[string]interface{})["endpoint"].(map[string]interface{})
+		if endpoint != nil {
+			controlled = req.URL.Host + " " + endpoint["endpointId"].(string)
+			return stubResponse(http.StatusOK, `{"event":{"endpoint":{"endpointId":"light#kitchen"}}}`), nil
+		}
+		return stubResponse(http.StatusOK, `{"event":{"payload":{"endpoints":[{"endpointId":"light#kitchen"}]}}}`), nil
+	})
+
+	response, err := handler.HandleRequest(context.Background(), discoveryEvent())
+	if err != nil {
+		t.Fatalf("Discovery returned an error: %v", err)
+	}
+	endpoints := responsePayload(response)["endpoints"].([]interface{})
+	if len(endpoints) != 2 ||
+		endpoints[0].(map[string]interface{})["endpointId"] != "house:light#kitchen" ||
+		endpoints[1].(map[string]interface{})["endpointId"] != "cabin:light#kitchen" {
+		t.Errorf("Unexpected merged endpoints: %v", endpoints)
+	}
+
+	event := powerEvent("cabin:light#kitchen")
+	response, err = handler.HandleRequest(context.Background(), event)
+	if err != nil {
+		t.Fatalf("TurnOn returned an error: %v", err)
+	}
+	if controlled != "cabin.example light#kitchen" {
+		t.Errorf("Expected the cabin to get light#kitchen, got %q", controlled)
+	}
+	if id := response["event"].(map[string]interface{})["endpoint"].(map[string]interface{})["endpointId"]; id != "cabin:light#kitchen" {
+		t.Errorf("Expected the prefixed endpointId in the response, got %v", id)
+	}
+	if id := event["directive"].(map[string]interface{})["endpoint"].(map[string]interface{})["endpointId"]; id != "cabin:light#kitchen" {
+		t.Errorf("Expected the original event to be untouched, got %v", id)
+	}
+
+	if _, err := handler.HandleRequest(context.Background(), powerEvent("garage:light#door")); err != errUnknownEndpoint {
+		t.Errorf("Expected errUnknownEndpoint, got %v", err)
+	}
+}
+
+func powerEvent(endpointID string) map[string]interface{} {
+	return map[string]interface{}{
+		"directive": map[string]interface{}{
+			"header": map[string]interface{}{
+				"namespace":      "Alexa.PowerController",
+				"name":           "TurnOn",
+				"payloadVersion": "3",
+				"messageId":      "message-id",
+			},
+			"endpoint": map[string]interface{}{
+				"endpointId": endpointID,
+				"scope": map[string]interface{}{
+					"type":  "BearerToken",
+					"token": "access-token-from-skill",
+				},
+			},
+			"payload": map[string]interface{}{},
+		},
+	}
+}
+
+// Test that discovery fails, and nothing is cached, when a backend fails
+func TestHandleRequest_AggregateBackendDown(t *testing.T) {
+	t.Parallel()
+	backends := filepath.Join(t.TempDir(), "backends.json")
+	os.WriteFile(backends, []byte(`[
+		{"name": "house", "baseUrl": "http://house.example", "token": "house-token"},
+		{"name": "cabin", "baseUrl": "http://cabin.example", "token": "cabin-token"}
+	]`), 0o600)
+	handler := newTestHandler(t, Config{BackendsFile: backends, DiscoveryCacheTTL: time.Minute})
+
+	cabinDown := true
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "cabin.example" && cabinDown {
+			return nil, errors.New("connection refused")
+		}
+		return stubResponse(http.StatusOK, `{"event":{"payload":{"endpoints":[{"endpointId":"light#kitchen"}]}}}`), nil
+	})
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err == nil {
+		t.Fatal("Expected discovery to fail with a backend down")
+	}
+	cabinDown = false
+	response, err := handler.HandleRequest(context.Background(), discoveryEvent())
+	if err != nil {
+		t.Fatalf("Discovery returned an error: %v", err)
+	}
+	if endpoints := responsePayload(response)["endpoints"].([]interface{}); len(endpoints) != 2 {
+		t.Errorf("Expected both backends' endpoints, got %v", endpoints)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+)
+
+// Builders for responses the proxy answers itself instead of Home Assistant.
+
+// newMessageID returns a random version 4 UUID for an event header.
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// eventHeader answers directive with an event of namespace and name,
+// carrying over its correlation token.
+func eventHeader(directive map[string]interface{}, namespace, name string) map[string]interface{} {
+	header := map[string]interface{}{
+		"namespace":      namespace,
+		"name":           name,
+		"payloadVersion": "3",
+		"messageId":      newMessageID(),
+	}
+	if in, ok := directive["header"].(map[string]interface{}); ok {
+		if token, ok := in["correlationToken"].(string); ok {
+			header["correlationToken"] = token
+		}
+	}
+	return header
+}
+
+// alexaResponse builds the generic Alexa.Response for a directive, or
+// AcceptGrant.Response for an AcceptGrant.
+func alexaResponse(event map[string]interface{}) map[string]interface{} {
+	directive, _ := event["directive"].(map[string]interface{})
+	header, _ := directive["header"].(map[string]interface{})
+	if header["namespace"] == "Alexa.Authorization" {
+		return map[string]interface{}{
+			"event": map[string]interface{}{
+				"header":  eventHeader(directive, "Alexa.Authorization", "AcceptGrant.Response"),
+				"payload": map[string]interface{}{},
+			},
+		}
+	}
+
+	response := map[string]interface{}{
+		"header":  eventHeader(directive, "Alexa", "Response"),
+		"payload": map[string]interface{}{},
+	}
+	if endpoint, ok := directive["endpoint"].(map[string]interface{}); ok {
+		response["endpoint"] = endpoint
+	}
+	return map[string]interface{}{"event": response}
+}
+
+// alexaErrorResponse builds an Alexa.ErrorResponse of errorType for a
+// directive.
+func alexaErrorResponse(event map[string]interface{}, errorType, message string) map[string]interface{} {
+	directive, _ := event["directive"].(map[string]interface{})
+	response := map[string]interface{}{
+		"header": eventHeader(directive, "Alexa", "ErrorResponse"),
+		"payload": map[string]interface{}{
+			"type":    errorType,
+			"message": message,
+		},
+	}
+	if endpoint, ok := directive["endpoint"].(map[string]interface{}); ok {
+		response["endpoint"] = endpoint
+	}
+	return map[string]interface{}{"event": response}
+}
+
+// dryRun answers a state-changing directive without calling Home Assistant:
+// with a synthetic success for DRY_RUN=true, or an error Alexa reads out for
+// DRY_RUN=refuse.
+func (h *LambdaHandler) dryRun(ctx context.Context, info directiveInfo, event map[string]interface{}) map[string]interface{} {
+	h.logger(ctx).Sugar().Infof("Dry run, not sending %s.%s for endpoint %q", info.Namespace, info.Name, info.EndpointID)
+	if h.config.DryRun == "refuse" {
+		return alexaErrorResponse(event, "NOT_SUPPORTED_IN_CURRENT_MODE", "dry run, directive not sent to Home Assistant")
+	}
+	return alexaResponse(event)
+}
+
+// checkResponse makes sure a Home Assistant reply has a usable event header
+// before it goes back to Alexa, which drops malformed responses silently.
+// Omissions the proxy can fill in, a messageId, payloadVersion or the
+// directive's correlationToken, are patched; every problem is logged.
+func (h *LambdaHandler) checkResponse(ctx context.Context, info directiveInfo, response map[string]interface{}) {
+	e, ok := response["event"].(map[string]interface{})
+	if !ok {
+		h.logger(ctx).Sugar().Warnf("Response to %s.%s has no event", info.Namespace, info.Name)
+		return
+	}
+	header, ok := e["header"].(map[string]interface{})
+	if !ok {
+		h.logger(ctx).Sugar().Warnf("Response to %s.%s has no event.header", info.Namespace, info.Name)
+		return
+	}
+
+	for _, field := range []string{"namespace", "name"} {
+		if value, _ := header[field].(string); value == "" {
+			h.logger(ctx).Sugar().Warnf("Response to %s.%s has no event.header.%s", info.Namespace, info.Name, field)
+		}
+	}
+	if value, _ := header["messageId"].(string); value == "" {
+		h.logger(ctx).Sugar().Warnf("Response to %s.%s has no messageId, adding one", info.Namespace, info.Name)
+		header["messageId"] = newMessageID()
+	}
+	if value, _ := header["payloadVersion"].(string); value == "" {
+		h.logger(ctx).Sugar().Warnf("Response to %s.%s has no payloadVersion, adding 3", info.Namespace, info.Name)
+		header["payloadVersion"] = "3"
+	}
+	if _, ok := header["correlationToken"]; !ok && info.CorrelationToken != "" {
+		h.logger(ctx).Sugar().Warnf("Response to %s.%s has no correlationToken, copying the directive's", info.Namespace, info.Name)
+		header["correlationToken"] = info.CorrelationToken
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+// Test that dry run answers control directives without calling Home Assistant
+func TestHandleRequest_DryRun(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []string{"true", "refuse"} {
+		handler := newTestHandler(t, Config{BaseURL: "http://hass.example", DryRun: mode})
+		calls := 0
+		handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+			calls++
+			return stubResponse(http.StatusOK, `{"event":{}}`), nil
+		})
+
+		event := powerEvent("light#kitchen")
+		event["directive"].(map[string]interface{})["header"].(map[string]interface{})["correlationToken"] = "correlation"
+		response, err := handler.HandleRequest(context.Background(), event)
+		if err != nil {
+			t.Fatalf("%s: handler returned an error: %v", mode, err)
+		}
+		if calls != 0 {
+			t.Errorf("%s: expected no upstream call, got %d", mode, calls)
+		}
+
+		header := response["event"].(map[string]interface{})["header"].(map[string]interface{})
+		expected := map[string]string{"true": "Response", "refuse": "ErrorResponse"}[mode]
+		if header["name"] != expected || header["correlationToken"] != "correlation" {
+			t.Errorf("%s: unexpected header %v", mode, header)
+		}
+
+		// Read-only directives still reach Home Assistant
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil || calls != 1 {
+			t.Errorf("%s: expected discovery to be forwarded, got %d calls (%v)", mode, calls, err)
+		}
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	t.Parallel()
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if id := newMessageID(); !uuid.MatchString(id) {
+		t.Errorf("Expected a v4 UUID, got %q", id)
+	}
+}
+
+// Test that omissions in Home Assistant's reply are patched
+func TestHandleRequest_CheckResponse(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example"})
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"event":{"header":{"namespace":"Alexa","name":"Response"},"payload":{}}}`), nil
+	})
+
+	event := powerEvent("light#kitchen")
+	event["directive"].(map[string]interface{})["header"].(map[string]interface{})["correlationToken"] = "correlation"
+	response, err := handler.HandleRequest(context.Background(), event)
+	if err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	header := response["event"].(map[string]interface{})["header"].(map[string]interface{})
+	if header["messageId"] == nil || header["payloadVersion"] != "3" || header["correlationToken"] != "correlation" {
+		t.Errorf("Expected a patched header, got %v", header)
+	}
+}
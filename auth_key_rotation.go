@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+const (
+	tailscaleAPI = "https://api.tailscale.com/api/v2"
+	// Auth keys minted by an OAuth client expire after at most 90 days.
+	authKeyExpiry = 90 * 24 * time.Hour
+	// Bound on joining the tailnet with a fresh key before it is stored.
+	authKeyVerifyTimeout = 20 * time.Second
+)
+
+// loadAuthKey reads TS_AUTHKEY from TS_AUTHKEY_SECRET.
+func loadAuthKey(ctx context.Context, spec string) (string, error) {
+	secret, err := openSecret(ctx, "TS_AUTHKEY_SECRET", spec)
+	if err != nil {
+		return "", err
+	}
+	return secret.load(ctx)
+}
+
+// isRotateAuthKey reports whether event asks for TS_AUTHKEY to be rotated,
+// e.g. {"rotateAuthKey": true} from an EventBridge schedule.
+func isRotateAuthKey(event map[string]interface{}) bool {
+	rotate, _ := event["rotateAuthKey"].(bool)
+	return rotate
+}
+
+// authKeyRotator mints auth keys with the Tailscale API before the stored
+// one expires.
+type authKeyRotator struct {
+	api          string
+	http         HTTPDoer
+	clientID     string
+	clientSecret string
+	// Tags for the new key when the current one can't be read
+	tags   []string
+	before time.Duration
+	secret secret
+	// verify joins the tailnet with a key, see verifyAuthKey
+	verify func(ctx context.Context, key string) error
+}
+
+func (h *LambdaHandler) newAuthKeyRotator(ctx context.Context) (*authKeyRotator, error) {
+	cfg := h.config
+	if cfg.TSAuthKeySecret == "" || cfg.TSAPIClientID == "" || cfg.TSAPIClientSecret == "" {
+		return nil, fmt.Errorf("rotating the auth key needs TS_AUTHKEY_SECRET, TS_API_CLIENT_ID and TS_API_CLIENT_SECRET")
+	}
+	secret, err := openSecret(ctx, "TS_AUTHKEY_SECRET", cfg.TSAuthKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	r := &authKeyRotator{
+		api:          tailscaleAPI,
+		http:         &http.Client{Timeout: 10 * time.Second},
+		clientID:     cfg.TSAPIClientID,
+		clientSecret: cfg.TSAPIClientSecret,
+		before:       cfg.TSAuthKeyRotateBefore,
+		secret:       secret,
+		verify: func(ctx context.Context, key string) error {
+			return verifyAuthKey(ctx, cfg, key)
+		},
+	}
+	if cfg.TSAuthKeyTags != "" {
+		r.tags = strings.Split(cfg.TSAuthKeyTags, ",")
+	}
+	return r, nil
+}
+
+// authKey is a key as returned by the Tailscale API.
+type authKey struct {
+	ID           string          `json:"id"`
+	Key          string          `json:"key,omitempty"`
+	Expires      time.Time       `json:"expires"`
+	Capabilities json.RawMessage `json:"capabilities"`
+}
+
+type rotationResult struct {
+	Rotated bool
+	KeyID   string
+	Expires time.Time
+}
+
+// rotate replaces the stored key when it expires within before, or can't be
+// found. The new key takes over the current key's capabilities, is used to
+// join the tailnet once, and is stored only when that works; the current key
+// is left to expire, so environments still holding it aren't affected.
+func (r *authKeyRotator) rotate(ctx context.Context) (rotationResult, error) {
+	current, err := r.secret.load(ctx)
+	if err != nil {
+		return rotationResult{}, fmt.Errorf("failed to read the auth key: %w", err)
+	}
+	token, err := r.accessToken(ctx)
+	if err != nil {
+		return rotationResult{}, err
+	}
+
+	capabilities := json.RawMessage(nil)
+	if id := authKeyID(current); id != "" {
+		var existing authKey
+		err := r.call(ctx, token, http.MethodGet, "/tailnet/-/keys/"+id, nil, &existing)
+		switch {
+		case err != nil:
+			// Expired keys are no longer listed; rotate with TS_AUTHKEY_TAGS
+		case time.Until(existing.Expires) > r.before:
+			return rotationResult{KeyID: existing.ID, Expires: existing.Expires}, nil
+		default:
+			capabilities = existing.Capabilities
+		}
+	}
+	if capabilities == nil {
+		if len(r.tags) == 0 {
+			return rotationResult{}, fmt.Errorf("the current auth key can't be read and TS_AUTHKEY_TAGS is not set")
+		}
+		capabilities, _ = json.Marshal(map[string]interface{}{
+			"devices": map[string]interface{}{
+				"create": map[string]interface{}{"reusable": true, "ephemeral": true, "preauthorized": true, "tags": r.tags},
+			},
+		})
+	}
+
+	var created authKey
+	in := map[string]interface{}{
+		"capabilities":  capabilities,
+		"expirySeconds": int(authKeyExpiry.Seconds()),
+		"description":   "hass-tailscale-lambda",
+	}
+	if err := r.call(ctx, token, http.MethodPost, "/tailnet/-/keys", in, &created); err != nil {
+		return rotationResult{}, fmt.Errorf("failed to create an auth key: %w", err)
+	}
+	if err := r.verify(ctx, created.Key); err != nil {
+		r.call(ctx, token, http.MethodDelete, "/tailnet/-/keys/"+created.ID, nil, nil)
+		return rotationResult{}, fmt.Errorf("new auth key %s failed to join the tailnet, revoked it: %w", created.ID, err)
+	}
+	if err := r.secret.store(ctx, created.Key); err != nil {
+		r.call(ctx, token, http.MethodDelete, "/tailnet/-/keys/"+created.ID, nil, nil)
+		return rotationResult{}, fmt.Errorf("failed to store auth key %s, revoked it: %w", created.ID, err)
+	}
+	return rotationResult{Rotated: true, KeyID: created.ID, Expires: created.Expires}, nil
+}
+
+// accessToken exchanges the OAuth client's credentials for an API token.
+func (r *authKeyRotator) accessToken(ctx context.Context) (string, error) {
+	form := url.Values{"client_id": {r.clientID}, "client_secret": {r.clientSecret}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.api+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := r.send(req, &token); err != nil {
+		return "", fmt.Errorf("failed to authenticate with the Tailscale API: %w", err)
+	}
+	return token.AccessToken, nil
+}
+
+func (r *authKeyRotator) call(ctx context.Context, token, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.api+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return r.send(req, out)
+}
+
+func (r *authKeyRotator) send(req *http.Request, out interface{}) error {
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: status code: %d: %s", req.Method, req.URL.Path, resp.StatusCode, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// authKeyID returns the id part of an auth key, tskey-auth-<id>-<secret>.
+func authKeyID(key string) string {
+	rest, ok := strings.CutPrefix(key, "tskey-auth-")
+	if !ok {
+		return ""
+	}
+	id, _, _ := strings.Cut(rest, "-")
+	return id
+}
+
+// verifyAuthKey joins the tailnet with key as a throwaway ephemeral node.
+func verifyAuthKey(ctx context.Context, cfg Config, key string) error {
+	dir, err := os.MkdirTemp("", "tskeycheck")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(ctx, authKeyVerifyTimeout)
+	defer cancel()
+	server := &tsnet.Server{
+		AuthKey:    key,
+		ControlURL: cfg.TSControlURL,
+		Ephemeral:  true,
+		Hostname:   cfg.TSHostname + "-keycheck",
+		Dir:        dir,
+	}
+	defer server.Close()
+	if _, err := server.Up(ctx); err != nil {
+		return err
+	}
+	if lc, err := server.LocalClient(); err == nil {
+		lc.Logout(ctx)
+	}
+	return nil
+}
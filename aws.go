@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// awsClient sends SigV4-signed requests to AWS service endpoints. The few S3
+// calls the proxy makes don't justify vendoring the full service SDKs.
+type awsClient struct {
+	cfg    aws.Config
+	signer *v4.Signer
+	http   *http.Client
+}
+
+func newAWSClient(ctx context.Context) (*awsClient, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return &awsClient{
+		cfg:    cfg,
+		signer: v4.NewSigner(),
+		http:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// awsError is an error status returned by an AWS service.
+type awsError struct {
+	service, method string
+	status          int
+	body            string
+}
+
+func (e *awsError) Error() string {
+	return fmt.Sprintf("%s %s: status code: %d: %s", e.service, e.method, e.status, e.body)
+}
+
+// do signs and sends a request for service. Responses with an error status
+// are returned as errors including the body AWS sent back.
+func (c *awsClient) do(ctx context.Context, method, url, service string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	// S3 signs the path as sent, which objectURL has already escaped
+	noEscape := func(o *v4.SignerOptions) { o.DisableURIPathEscaping = service == "s3" }
+	if err := c.signer.SignHTTP(ctx, creds, req, payloadHash, service, c.cfg.Region, time.Now(), noEscape); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &awsError{service: service, method: method, status: resp.StatusCode, body: string(msg)}
+	}
+	return resp, nil
+}
+
+// objectURL returns the URL of s3://bucket/key with the key escaped the way
+// S3 signs it. Buckets with dots in their name get a path-style URL, as the
+// virtual-hosted name wouldn't match S3's wildcard certificate.
+func (c *awsClient) objectURL(bucket, key string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(key) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9', strings.IndexByte("-_.~/", b) >= 0:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	if strings.Contains(bucket, ".") {
+		return fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", c.cfg.Region, bucket, escaped.String())
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, c.cfg.Region, escaped.String())
+}
+
+// putObject uploads body to s3://bucket/key.
+func (c *awsClient) putObject(ctx context.Context, bucket, key, contentType string, body []byte) error {
+	url := c.objectURL(bucket, key)
+	header := http.Header{"Content-Type": {contentType}}
+	resp, err := c.do(ctx, http.MethodPut, url, "s3", header, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// getObject downloads s3://bucket/key.
+func (c *awsClient) getObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	url := c.objectURL(bucket, key)
+	resp, err := c.do(ctx, http.MethodGet, url, "s3", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// callJSON invokes an AWS JSON protocol API such as DynamoDB's (version
+// "1.0") or SSM's ("1.1"), where the operation is named by X-Amz-Target.
+func (c *awsClient) callJSON(ctx context.Context, service, version, target string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("https://%s.%s.amazonaws.com/", service, c.cfg.Region)
+	header := http.Header{
+		"Content-Type": {"application/x-amz-json-" + version},
+		"X-Amz-Target": {target},
+	}
+	resp, err := c.do(ctx, http.MethodPost, url, service, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
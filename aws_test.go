@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// fakeAWS returns an awsClient that sends every request to handler, which
+// sees the AWS endpoint in r.Host.
+func fakeAWS(t *testing.T, handler http.Handler) *awsClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	creds := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+	})
+	return &awsClient{
+		cfg:    aws.Config{Region: "eu-west-1", Credentials: creds},
+		signer: v4.NewSigner(),
+		http:   &http.Client{Transport: redirectTransport{host: server.Listener.Addr().String()}},
+	}
+}
+
+type redirectTransport struct {
+	host string
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Test that object keys are escaped and dotted buckets use path-style URLs
+func TestAWSClient_ObjectURL(t *testing.T) {
+	t.Parallel()
+	var host, uri string
+	client := fakeAWS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, uri = r.Host, r.RequestURI
+	}))
+
+	tests := []struct {
+		bucket, key, host, uri string
+	}{
+		{"state", "dev/tailscale/_machinekey", "state.s3.eu-west-1.amazonaws.com", "/dev/tailscale/_machinekey"},
+		{"state", "tokens/a:b c+d", "state.s3.eu-west-1.amazonaws.com", "/tokens/a%3Ab%20c%2Bd"},
+		{"hass.example.com", "records/x", "s3.eu-west-1.amazonaws.com", "/hass.example.com/records/x"},
+	}
+	for _, tt := range tests {
+		if _, err := client.getObject(context.Background(), tt.bucket, tt.key); err != nil {
+			t.Fatalf("getObject(%q, %q) returned an error: %v", tt.bucket, tt.key, err)
+		}
+		if host != tt.host || uri != tt.uri {
+			t.Errorf("getObject(%q, %q) requested %s%s, expected %s%s", tt.bucket, tt.key, host, uri, tt.host, tt.uri)
+		}
+	}
+}
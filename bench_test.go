@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func discoveryEvent() map[string]interface{} {
+	return map[string]interface{}{
+		"directive": map[string]interface{}{
+			"header": map[string]interface{}{
+				"namespace":      "Alexa.Discovery",
+				"name":           "Discover",
+				"payloadVersion": "3",
+				"messageId":      "1bd5d003-31b9-476f-ad03-71d471922820",
+			},
+			"payload": map[string]interface{}{
+				"scope": map[string]interface{}{
+					"type":  "BearerToken",
+					"token": "access-token-from-skill",
+				},
+			},
+		},
+	}
+}
+
+func BenchmarkExtractScope(b *testing.B) {
+	handler := newTestHandler(b, Config{BaseURL: "http://localhost"})
+	directive := discoveryEvent()["directive"].(map[string]interface{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if handler.extractScope(directive) == nil {
+			b.Fatal("scope not found")
+		}
+	}
+}
+
+func BenchmarkParseDirective(b *testing.B) {
+	handler := &LambdaHandler{Logger: zap.NewNop()}
+	event := discoveryEvent()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := handler.parseDirective(context.Background(), event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreateHTTPClient(b *testing.B) {
+	handler := newTestHandler(b, Config{
+		BaseURL:      "http://localhost",
+		NotVerifySSL: true,
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.createHTTPClient()
+	}
+}
+
+func BenchmarkHandleRequest(b *testing.B) {
+	upstream := mockServer(http.StatusOK, map[string]interface{}{
+		"event": map[string]interface{}{
+			"header": map[string]interface{}{
+				"namespace": "Alexa.Discovery",
+				"name":      "Discover.Response",
+			},
+		},
+	})
+	defer upstream.Close()
+
+	handler := newTestHandler(b, Config{BaseURL: upstream.URL})
+	event := discoveryEvent()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := handler.HandleRequest(context.Background(), event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeEvent(b *testing.B) {
+	event := discoveryEvent()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := getJSONBuffer()
+		if err := buf.enc.Encode(event); err != nil {
+			b.Fatal(err)
+		}
+		putJSONBuffer(buf)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var cameraEntity = regexp.MustCompile(`^camera\.[a-z0-9_]+$`)
+
+// newCameraMux serves camera images from Home Assistant's camera proxy:
+//
+//	GET /camera/<entity_id>         current snapshot
+//	GET /camera/<entity_id>/stream  MJPEG stream
+//
+// Callers authenticate with CAMERA_ACCESS_TOKEN as a bearer token or, for
+// <img> tags, a token query parameter. ENTITY_ALLOW and ENTITY_DENY apply.
+func (h *LambdaHandler) newCameraMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/camera/", h.serveCamera)
+	return mux
+}
+
+func (h *LambdaHandler) serveCamera(w http.ResponseWriter, r *http.Request) {
+	given := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if h.config.CameraToken == "" || subtle.ConstantTimeCompare([]byte(given), []byte(h.config.CameraToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entity, stream := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/camera/"), "/stream")
+	if !cameraEntity.MatchString(entity) || (h.entities != nil && !h.entities.allowed(entity)) {
+		http.NotFound(w, r)
+		return
+	}
+	path := "/api/camera_proxy/"
+	if stream {
+		path = "/api/camera_proxy_stream/"
+	}
+
+	token, err := h.accessToken(r.Context())
+	if err != nil {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, fmt.Sprintf("%s%s%s", h.BaseURL, path, entity), nil)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := h.streamingClient().Do(req)
+	if err != nil {
+		h.logger(r.Context()).Sugar().Warnf("Error fetching %s: %v", entity, err)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, name := range []string{"Content-Type", "Content-Length", "Cache-Control"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if !stream {
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	// Pass each chunk on as it arrives rather than buffering the stream
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// streamingClient is httpClient without the overall timeout, which would cut
+// an MJPEG stream off; the caller's context bounds it instead. It shares the
+// transport and its connections.
+func (h *LambdaHandler) streamingClient() HTTPDoer {
+	if h.HTTPClient != nil {
+		return h.httpClient()
+	}
+	streaming := *h.sharedClient()
+	streaming.Timeout = 0
+	return h.withUpstreamAuth(&streaming)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeCamera(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", LongLivedToken: "token", CameraToken: "camera-secret", EntityDeny: "camera.bedroom"})
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Expected the Home Assistant token, got %q", req.Header.Get("Authorization"))
+		}
+		resp := stubResponse(http.StatusOK, req.URL.Path)
+		resp.Header = http.Header{"Content-Type": {"image/jpeg"}}
+		return resp, nil
+	})
+	mux := handler.newCameraMux()
+
+	tests := []struct {
+		name   string
+		path   string
+		auth   string
+		status int
+		body   string
+	}{
+		{"snapshot", "/camera/camera.front_door", "Bearer camera-secret", http.StatusOK, "/api/camera_proxy/camera.front_door"},
+		{"stream", "/camera/camera.front_door/stream", "Bearer camera-secret", http.StatusOK, "/api/camera_proxy_stream/camera.front_door"},
+		{"query token", "/camera/camera.front_door?token=camera-secret", "", http.StatusOK, "/api/camera_proxy/camera.front_door"},
+		{"no token", "/camera/camera.front_door", "", http.StatusUnauthorized, ""},
+		{"wrong token", "/camera/camera.front_door", "Bearer token", http.StatusUnauthorized, ""},
+		{"not a camera", "/camera/light.kitchen", "Bearer camera-secret", http.StatusNotFound, ""},
+		{"nested path", "/camera/camera.front_door/snapshot", "Bearer camera-secret", http.StatusNotFound, ""},
+		{"denied", "/camera/camera.bedroom", "Bearer camera-secret", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, rec.Code)
+		}
+		if tt.body != "" && (rec.Body.String() != tt.body || rec.Header().Get("Content-Type") != "image/jpeg") {
+			t.Errorf("%s: unexpected relay %q (%s)", tt.name, rec.Body.String(), rec.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds everything the handler reads from the environment. Tests and
+// embedders build it directly instead of mutating process env.
+type Config struct {
+	// Stage, e.g. dev or prod, separates deployments sharing an account
+	Stage string
+
+	BaseURL        string
+	Debug          bool
+	LongLivedToken string
+	NotVerifySSL   bool
+	ValidateToken  bool
+	// LogFormat is "json" or "console", empty keeps zap's defaults
+	LogFormat string
+
+	// Instead of LongLivedToken, see ha_auth.go
+	RefreshToken string
+	ClientID     string
+	// Headers for an auth layer in front of Home Assistant, see upstream_auth.go
+	UpstreamAuthSecret string
+
+	// Tailnet
+	TSAuthKey    string
+	TSDir        string
+	TSControlURL string
+	TSHostname   string
+	// Durable node state and tokens, see store.go
+	StateStore string
+	// A node of its own for every execution environment
+	TSNodePerEnvironment bool
+	// Idle time after which the tailnet is re-established, see restore.go
+	TailnetIdleReset time.Duration
+	// Where TS_AUTHKEY is read from and rotated to, see auth_key_rotation.go
+	TSAuthKeySecret       string
+	TSAPIClientID         string
+	TSAPIClientSecret     string
+	TSAuthKeyTags         string
+	TSAuthKeyRotateBefore time.Duration
+
+	// Multi-instance routing, see routes.go
+	RoutesFile  string
+	RoutesTable string
+	// Instances merged into one skill, see aggregate.go
+	BackendsFile string
+	// Per-tenant settings under {TenantSSMPrefix}/{tenant}/
+	TenantSSMPrefix string
+	TenantConfigTTL time.Duration
+	// Per-tenant limits, see quota.go
+	TenantRateLimit int
+	QuotaTable      string
+
+	EMFMetrics bool
+	// "true" or "refuse", see dryRun
+	DryRun string
+	// "strict" or "lenient", see compatibleVersion
+	PayloadVersionPolicy string
+	// Where exchanged short-lived tokens are cached, see token_cache.go
+	TokenCacheDir string
+	// Request metadata sent to Home Assistant, see provenance.go
+	ForwardHeaders []string
+
+	// Standby instance for BASE_URL, see failover.go
+	SecondaryBaseURL  string
+	SecondaryToken    string
+	FailoverThreshold int
+	FailoverCooldown  time.Duration
+	// Percentage of directives for BASE_URL sent to the secondary, or the
+	// AppConfig profile (application/environment/configuration) holding it
+	SplitPercent   int
+	SplitAppConfig string
+	// Error percentage of the secondary that rolls the split back
+	SplitMaxErrors int
+
+	// Instance read-only directives are mirrored to, see shadow.go
+	ShadowBaseURL string
+	ShadowToken   string
+	ShadowTimeout time.Duration
+
+	DiscoveryCacheTTL time.Duration
+	ReplayWindow      time.Duration
+	MaxClockSkew      time.Duration
+	// Entity patterns, see entity_filter.go
+	EntityAllow string
+	EntityDeny  string
+	// Extra places to look for the scope, see scope.go
+	ScopePaths string
+	// Fields dropped or truncated in responses, see strip.go
+	ResponseStrip stripRules
+	// Answer ReportState from cache with UNREACHABLE health when HA is down
+	EndpointHealthFallback bool
+	// Prefetch endpoint states after discovery
+	WarmStates bool
+	// Sanity checks of Alexa messages, see envelope.go
+	EnvelopeChecks bool
+
+	// Recording, see record.go
+	RecordMode   string
+	RecordDir    string
+	RecordBucket string
+	RecordPrefix string
+
+	// Server mode
+	ServerAddr        string
+	AdminAddr         string
+	WebhookFunnel     bool
+	DebugToken        string
+	KeepaliveInterval time.Duration
+	MaxInFlight       int
+	// Where BASE_URL's host is dialed instead, see dial.go
+	UpstreamDial string
+
+	// Camera relay
+	CameraRelay bool
+	CameraToken string
+}
+
+// ConfigFromEnv reads the configuration from environment variables.
+func ConfigFromEnv() (Config, error) {
+	return configFromLookup(os.Getenv)
+}
+
+func configFromLookup(getenv func(string) string) (Config, error) {
+	stage := getenv("STAGE")
+	if stage != "" {
+		getenv = stageLookup(getenv, stage)
+	}
+
+	cfg := Config{
+		Stage: stage,
+
+		BaseURL:        strings.TrimRight(getenv("BASE_URL"), "/"),
+		Debug:          getenv("DEBUG") == "true",
+		LongLivedToken: getenv("LONG_LIVED_ACCESS_TOKEN"),
+		NotVerifySSL:   getenv("NOT_VERIFY_SSL") == "true",
+		ValidateToken:  getenv("VALIDATE_TOKEN") == "true",
+		LogFormat:      getenv("LOG_FORMAT"),
+
+		RefreshToken: getenv("REFRESH_TOKEN"),
+		ClientID:     getenv("CLIENT_ID"),
+
+		UpstreamAuthSecret: getenv("UPSTREAM_AUTH_SECRET"),
+
+		TSAuthKey:    getenv("TS_AUTHKEY"),
+		TSDir:        getenv("TS_DIR"),
+		TSControlURL: getenv("TS_CONTROL_URL"),
+		TSHostname:   getenv("TS_HOSTNAME"),
+		StateStore:   getenv("STATE_STORE"),
+
+		TSNodePerEnvironment: getenv("TS_NODE_PER_ENVIRONMENT") == "true",
+
+		TSAuthKeySecret:   getenv("TS_AUTHKEY_SECRET"),
+		TSAPIClientID:     getenv("TS_API_CLIENT_ID"),
+		TSAPIClientSecret: getenv("TS_API_CLIENT_SECRET"),
+		TSAuthKeyTags:     getenv("TS_AUTHKEY_TAGS"),
+
+		RoutesFile:  getenv("ROUTES_FILE"),
+		RoutesTable: getenv("ROUTES_TABLE"),
+
+		BackendsFile: getenv("BACKENDS_FILE"),
+
+		TenantSSMPrefix: getenv("TENANT_SSM_PREFIX"),
+		QuotaTable:      getenv("QUOTA_TABLE"),
+		EMFMetrics:      getenv("EMF_METRICS") == "true",
+		DryRun:          getenv("DRY_RUN"),
+		TokenCacheDir:   getenv("TOKEN_CACHE_DIR"),
+
+		PayloadVersionPolicy: getenv("PAYLOAD_VERSION_POLICY"),
+
+		SecondaryBaseURL: getenv("SECONDARY_BASE_URL"),
+		SecondaryToken:   getenv("SECONDARY_LONG_LIVED_ACCESS_TOKEN"),
+		SplitAppConfig:   getenv("SPLIT_APPCONFIG"),
+
+		ShadowBaseURL: getenv("SHADOW_BASE_URL"),
+		ShadowToken:   getenv("SHADOW_LONG_LIVED_ACCESS_TOKEN"),
+
+		EnvelopeChecks: getenv("ENVELOPE_CHECKS") == "true",
+
+		EndpointHealthFallback: getenv("ENDPOINT_HEALTH_FALLBACK") == "true",
+		WarmStates:             getenv("WARM_STATES") == "true",
+		EntityAllow:            getenv("ENTITY_ALLOW"),
+		EntityDeny:             getenv("ENTITY_DENY"),
+		ScopePaths:             getenv("SCOPE_PATHS"),
+
+		RecordMode:   getenv("RECORD_MODE"),
+		RecordDir:    getenv("RECORD_DIR"),
+		RecordBucket: getenv("RECORD_BUCKET"),
+		RecordPrefix: getenv("RECORD_PREFIX"),
+
+		ServerAddr:    getenv("SERVER_ADDR"),
+		AdminAddr:     getenv("TAILNET_ADMIN_ADDR"),
+		WebhookFunnel: getenv("WEBHOOK_FUNNEL") == "true",
+		DebugToken:    getenv("DEBUG_TOKEN"),
+		UpstreamDial:  getenv("UPSTREAM_DIAL"),
+
+		CameraRelay: getenv("CAMERA_RELAY") == "true",
+		CameraToken: getenv("CAMERA_ACCESS_TOKEN"),
+	}
+
+	if cfg.LogFormat == "" {
+		// Outside the Lambda runtime logs are read by a person, not CloudWatch
+		cfg.LogFormat = "json"
+		if getenv("AWS_LAMBDA_RUNTIME_API") == "" {
+			cfg.LogFormat = "console"
+		}
+	}
+	if cfg.TSHostname == "" {
+		cfg.TSHostname = tailnetHostname(getenv("AWS_LAMBDA_FUNCTION_NAME"), stage)
+	}
+	if cfg.TSNodePerEnvironment {
+		suffix := environmentSuffix(getenv("AWS_LAMBDA_LOG_STREAM_NAME"))
+		if max := 63 - len(suffix) - 1; len(cfg.TSHostname) > max {
+			cfg.TSHostname = strings.TrimRight(cfg.TSHostname[:max], "-")
+		}
+		cfg.TSHostname += "-" + suffix
+	}
+	if cfg.TSDir == "" {
+		cfg.TSDir = path.Join("/tmp/data", stage)
+	}
+	if cfg.RecordDir == "" {
+		cfg.RecordDir = path.Join("/tmp/recordings", stage)
+	}
+	if cfg.TokenCacheDir == "" {
+		cfg.TokenCacheDir = path.Join("/tmp/tokens", stage)
+	}
+	if stage != "" {
+		// Shared namespaces get a stage level of their own
+		if cfg.TenantSSMPrefix != "" && getenv("TENANT_SSM_PREFIX_"+strings.ToUpper(stage)) == "" {
+			cfg.TenantSSMPrefix = strings.TrimRight(cfg.TenantSSMPrefix, "/") + "/" + stage
+		}
+		if getenv("RECORD_PREFIX_"+strings.ToUpper(stage)) == "" {
+			cfg.RecordPrefix = path.Join(cfg.RecordPrefix, stage)
+		}
+	}
+	if cfg.ServerAddr == "" {
+		cfg.ServerAddr = ":8080"
+	}
+
+	switch cfg.DryRun {
+	case "", "true", "refuse":
+	case "false":
+		cfg.DryRun = ""
+	default:
+		return cfg, fmt.Errorf("invalid DRY_RUN: %q, expected true or refuse", cfg.DryRun)
+	}
+	switch cfg.PayloadVersionPolicy {
+	case "", "strict", "lenient":
+	default:
+		return cfg, fmt.Errorf("invalid PAYLOAD_VERSION_POLICY: %q, expected strict or lenient", cfg.PayloadVersionPolicy)
+	}
+
+	var err error
+	if cfg.ResponseStrip, err = parseStripRules(getenv("RESPONSE_STRIP")); err != nil {
+		return cfg, err
+	}
+	if cfg.ForwardHeaders, err = parseForwardHeaders(getenv("FORWARD_HEADERS")); err != nil {
+		return cfg, err
+	}
+	if cfg.DiscoveryCacheTTL, err = parseDuration(getenv, "DISCOVERY_CACHE_TTL"); err != nil {
+		return cfg, err
+	}
+	if cfg.ReplayWindow, err = parseDuration(getenv, "REPLAY_WINDOW"); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxClockSkew, err = parseDuration(getenv, "MAX_CLOCK_SKEW"); err != nil {
+		return cfg, err
+	}
+	if cfg.KeepaliveInterval, err = parseDuration(getenv, "KEEPALIVE_INTERVAL"); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxInFlight, err = parseInt(getenv, "MAX_IN_FLIGHT"); err != nil {
+		return cfg, err
+	}
+	if cfg.TenantConfigTTL, err = parseDuration(getenv, "TENANT_CONFIG_TTL"); err != nil {
+		return cfg, err
+	}
+	if cfg.TenantConfigTTL == 0 {
+		cfg.TenantConfigTTL = time.Minute
+	}
+	if cfg.TenantRateLimit, err = parseInt(getenv, "TENANT_RATE_LIMIT"); err != nil {
+		return cfg, err
+	}
+	if cfg.FailoverThreshold, err = parseInt(getenv, "FAILOVER_THRESHOLD"); err != nil {
+		return cfg, err
+	}
+	if cfg.FailoverThreshold <= 0 {
+		cfg.FailoverThreshold = 3
+	}
+	if cfg.FailoverCooldown, err = parseDuration(getenv, "FAILOVER_COOLDOWN"); err != nil {
+		return cfg, err
+	}
+	if cfg.FailoverCooldown == 0 {
+		cfg.FailoverCooldown = time.Minute
+	}
+	if cfg.SplitPercent, err = parseInt(getenv, "SPLIT_PERCENT"); err != nil {
+		return cfg, err
+	}
+	if cfg.SplitPercent < 0 || cfg.SplitPercent > 100 {
+		return cfg, fmt.Errorf("invalid SPLIT_PERCENT %d: not between 0 and 100", cfg.SplitPercent)
+	}
+	if cfg.SplitAppConfig != "" && len(strings.Split(cfg.SplitAppConfig, "/")) != 3 {
+		return cfg, fmt.Errorf("invalid SPLIT_APPCONFIG %q: expected application/environment/configuration", cfg.SplitAppConfig)
+	}
+	if _, _, ok := parseUpstreamDial(cfg.UpstreamDial); cfg.UpstreamDial != "" && !ok {
+		return cfg, fmt.Errorf("invalid UPSTREAM_DIAL %q: expected unix:/path or host:port", cfg.UpstreamDial)
+	}
+	if cfg.CameraRelay && cfg.CameraToken == "" {
+		return cfg, fmt.Errorf("CAMERA_RELAY requires CAMERA_ACCESS_TOKEN")
+	}
+	if cfg.SplitMaxErrors, err = parseInt(getenv, "SPLIT_MAX_ERROR_PERCENT"); err != nil {
+		return cfg, err
+	}
+	if cfg.SplitMaxErrors <= 0 {
+		cfg.SplitMaxErrors = 20
+	}
+	if cfg.TSAuthKeyRotateBefore, err = parseDuration(getenv, "TS_AUTHKEY_ROTATE_BEFORE"); err != nil {
+		return cfg, err
+	}
+	if cfg.TSAuthKeyRotateBefore == 0 {
+		cfg.TSAuthKeyRotateBefore = 14 * 24 * time.Hour
+	}
+	if cfg.TailnetIdleReset, err = parseDuration(getenv, "TAILNET_IDLE_RESET"); err != nil {
+		return cfg, err
+	}
+	if cfg.ShadowTimeout, err = parseDuration(getenv, "SHADOW_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.ShadowTimeout == 0 {
+		cfg.ShadowTimeout = 2 * time.Second
+	}
+	return cfg, nil
+}
+
+func parseDuration(getenv func(string) string, name string) (time.Duration, error) {
+	v := getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d, nil
+}
+
+func parseInt(getenv func(string) string, name string) (int, error) {
+	v := getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// stageLookup prefers NAME_<STAGE> over NAME, so one set of environment
+// variables can hold the settings of several stages.
+func stageLookup(getenv func(string) string, stage string) func(string) string {
+	suffix := "_" + strings.ToUpper(stage)
+	return func(name string) string {
+		if value := getenv(name + suffix); value != "" {
+			return value
+		}
+		return getenv(name)
+	}
+}
+
+// environmentSuffix identifies the execution environment by its log stream,
+// which is unique to it, or randomly outside Lambda.
+func environmentSuffix(logStream string) string {
+	if logStream == "" {
+		var b [3]byte
+		rand.Read(b[:])
+		return hex.EncodeToString(b[:])
+	}
+	return tokenHash(logStream)[:6]
+}
+
+// tailnetHostname names the node after the function and STAGE, e.g.
+// hass-proxy-prod, so nodes can be told apart in the admin console. A
+// function already named after its stage keeps its name. The published
+// version is left out so the node keeps its MagicDNS name across deploys.
+// Outside Lambda it falls back to hass-alexa-lambda.
+func tailnetHostname(function, stage string) string {
+	if function == "" {
+		function = "hass-alexa-lambda"
+	}
+	hostname := dnsLabel(function)
+	if stage := dnsLabel(stage); stage != "" && hostname != stage && !strings.HasSuffix(hostname, "-"+stage) {
+		hostname += "-" + stage
+	}
+	// DNS labels are at most 63 characters
+	if len(hostname) > 63 {
+		hostname = strings.TrimRight(hostname[:63], "-")
+	}
+	return hostname
+}
+
+// dnsLabel lowercases s and replaces what a DNS label can't hold with dashes.
+func dnsLabel(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
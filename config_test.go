@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigFromLookup(t *testing.T) {
+	t.Parallel()
+	env := map[string]string{
+		"BASE_URL":            "https://hass.example/",
+		"NOT_VERIFY_SSL":      "true",
+		"DISCOVERY_CACHE_TTL": "30s",
+		"MAX_IN_FLIGHT":       "4",
+	}
+
+	cfg, err := configFromLookup(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("configFromLookup returned an error: %v", err)
+	}
+	if cfg.BaseURL != "https://hass.example" {
+		t.Errorf("Expected trailing slash to be trimmed, got %q", cfg.BaseURL)
+	}
+	if !cfg.NotVerifySSL {
+		t.Error("Expected NotVerifySSL")
+	}
+	if cfg.DiscoveryCacheTTL != 30*time.Second {
+		t.Errorf("Unexpected DiscoveryCacheTTL %v", cfg.DiscoveryCacheTTL)
+	}
+	if cfg.MaxInFlight != 4 {
+		t.Errorf("Unexpected MaxInFlight %d", cfg.MaxInFlight)
+	}
+	if cfg.ServerAddr != ":8080" || cfg.TSDir != "/tmp/data" {
+		t.Errorf("Expected defaults, got ServerAddr %q TSDir %q", cfg.ServerAddr, cfg.TSDir)
+	}
+
+	env["KEEPALIVE_INTERVAL"] = "soon"
+	if _, err := configFromLookup(func(name string) string { return env[name] }); err == nil {
+		t.Error("Expected an error for an invalid KEEPALIVE_INTERVAL")
+	}
+}
+
+func TestConfigFromLookup_Stage(t *testing.T) {
+	t.Parallel()
+	env := map[string]string{
+		"STAGE":                    "dev",
+		"AWS_LAMBDA_FUNCTION_NAME": "hass-proxy",
+		"BASE_URL":                 "https://hass.example",
+		"BASE_URL_DEV":             "https://hass-dev.example",
+		"LONG_LIVED_ACCESS_TOKEN":  "shared",
+		"TENANT_SSM_PREFIX":        "/hass/tenants/",
+		"RECORD_PREFIX_DEV":        "recordings",
+	}
+
+	cfg, err := configFromLookup(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("configFromLookup returned an error: %v", err)
+	}
+	if cfg.BaseURL != "https://hass-dev.example" || cfg.LongLivedToken != "shared" {
+		t.Errorf("Expected the stage BASE_URL and the shared token, got %q %q", cfg.BaseURL, cfg.LongLivedToken)
+	}
+	if cfg.TSHostname != "hass-proxy-dev" || cfg.TSDir != "/tmp/data/dev" {
+		t.Errorf("Expected stage node identity, got %q %q", cfg.TSHostname, cfg.TSDir)
+	}
+	if cfg.TenantSSMPrefix != "/hass/tenants/dev" || cfg.RecordPrefix != "recordings" {
+		t.Errorf("Unexpected prefixes %q %q", cfg.TenantSSMPrefix, cfg.RecordPrefix)
+	}
+}
+
+func TestConfigFromLookup_NodePerEnvironment(t *testing.T) {
+	t.Parallel()
+	env := map[string]string{
+		"BASE_URL":                   "https://hass.example",
+		"AWS_LAMBDA_FUNCTION_NAME":   strings.Repeat("a", 70),
+		"AWS_LAMBDA_LOG_STREAM_NAME": "2026/10/16/[$LATEST]0123456789abcdef",
+		"TS_NODE_PER_ENVIRONMENT":    "true",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	cfg, err := configFromLookup(getenv)
+	if err != nil {
+		t.Fatalf("configFromLookup returned an error: %v", err)
+	}
+	suffix := "-" + tokenHash(env["AWS_LAMBDA_LOG_STREAM_NAME"])[:6]
+	if len(cfg.TSHostname) != 63 || !strings.HasSuffix(cfg.TSHostname, suffix) {
+		t.Errorf("Expected a 63 character hostname ending in %s, got %q", suffix, cfg.TSHostname)
+	}
+	if again, _ := configFromLookup(getenv); again.TSHostname != cfg.TSHostname {
+		t.Errorf("Expected the same hostname within an environment, got %q and %q", cfg.TSHostname, again.TSHostname)
+	}
+}
+
+func TestNewLambdaHandler_RequiresBaseURL(t *testing.T) {
+	t.Parallel()
+	if _, err := NewLambdaHandler(Config{}, nil); err == nil {
+		t.Error("Expected an error without BaseURL")
+	}
+}
+
+func TestConfigFromLookup_LogFormat(t *testing.T) {
+	t.Parallel()
+	env := map[string]string{"BASE_URL": "https://hass.example"}
+	getenv := func(name string) string { return env[name] }
+
+	if cfg, _ := configFromLookup(getenv); cfg.LogFormat != "console" {
+		t.Errorf("Expected console logging outside Lambda, got %q", cfg.LogFormat)
+	}
+	env["AWS_LAMBDA_RUNTIME_API"] = "127.0.0.1:9001"
+	if cfg, _ := configFromLookup(getenv); cfg.LogFormat != "json" {
+		t.Errorf("Expected JSON logging under Lambda, got %q", cfg.LogFormat)
+	}
+	env["LOG_FORMAT"] = "console"
+	if cfg, _ := configFromLookup(getenv); cfg.LogFormat != "console" {
+		t.Errorf("Expected LOG_FORMAT to win, got %q", cfg.LogFormat)
+	}
+	if _, err := newLogger(Config{LogFormat: "xml"}); err == nil {
+		t.Error("Expected an error for an unknown LOG_FORMAT")
+	}
+}
+
+func TestTailnetHostname(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		function, stage, expected string
+	}{
+		{"", "", "hass-alexa-lambda"},
+		{"", "dev", "hass-alexa-lambda-dev"},
+		{"hass-proxy-prod", "", "hass-proxy-prod"},
+		{"Hass_Proxy", "prod", "hass-proxy-prod"},
+		{"hass-proxy-prod", "prod", "hass-proxy-prod"},
+		{"Hass_Proxy_PROD", "prod", "hass-proxy-prod"},
+		{"hass-proxy-preprod", "prod", "hass-proxy-preprod-prod"},
+		{strings.Repeat("a", 70), "dev", strings.Repeat("a", 63)},
+	}
+	for _, tt := range tests {
+		if got := tailnetHostname(tt.function, tt.stage); got != tt.expected {
+			t.Errorf("tailnetHostname(%q, %q) = %q, expected %q", tt.function, tt.stage, got, tt.expected)
+		}
+	}
+}
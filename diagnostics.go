@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var errSelfTestSkipped = errors.New("skipped, routing without BASE_URL has no instance of its own to discover")
+
+// checkResult is the outcome of a single diagnostic check.
+type checkResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// diagnosticsReport is returned for a self-test event.
+type diagnosticsReport struct {
+	OK          bool          `json:"ok"`
+	GeneratedAt time.Time     `json:"generatedAt"`
+	Checks      []checkResult `json:"checks"`
+}
+
+// isSelfTest reports whether event asks for a diagnostics report instead of
+// being forwarded, e.g. {"selfTest": true} from the Lambda console.
+func isSelfTest(event map[string]interface{}) bool {
+	selfTest, _ := event["selfTest"].(bool)
+	return selfTest
+}
+
+// runDiagnostics checks configuration, the tailnet and Home Assistant in
+// order. Checks after a failed prerequisite are skipped.
+func (h *LambdaHandler) runDiagnostics(ctx context.Context) diagnosticsReport {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	report := diagnosticsReport{OK: true, GeneratedAt: time.Now().UTC()}
+	add := func(c checkResult) bool {
+		report.Checks = append(report.Checks, c)
+		report.OK = report.OK && c.OK
+		return c.OK
+	}
+
+	if !add(h.checkConfig()) {
+		return report
+	}
+	if !add(h.checkTailnet(ctx)) {
+		return report
+	}
+	if !add(h.checkPeer(ctx)) {
+		return report
+	}
+	if !add(h.checkReachable(ctx)) {
+		return report
+	}
+	if !add(h.checkToken(ctx)) {
+		return report
+	}
+	if !add(h.checkSmartHome(ctx)) {
+		return report
+	}
+	if h.failover != nil {
+		add(h.checkFailover())
+	}
+	return report
+}
+
+// checkFailover fails while directives are being sent to the standby.
+func (h *LambdaHandler) checkFailover() checkResult {
+	c := checkResult{Name: "primary_active", OK: !h.failover.active()}
+	if !c.OK {
+		c.Detail = "directives are going to SECONDARY_BASE_URL"
+		c.Hint = "Check the primary Home Assistant; it is retried after FAILOVER_COOLDOWN"
+	}
+	return c
+}
+
+func (h *LambdaHandler) checkConfig() checkResult {
+	c := checkResult{Name: "config", OK: true, Detail: h.BaseURL}
+	if h.LongLivedToken == "" && h.config.RefreshToken == "" {
+		c.OK = false
+		c.Detail = "LONG_LIVED_ACCESS_TOKEN is empty"
+		c.Hint = "Create a long-lived access token on your Home Assistant profile page"
+	}
+	return c
+}
+
+func (h *LambdaHandler) checkTailnet(ctx context.Context) checkResult {
+	c := checkResult{Name: "tailnet"}
+	if h.TSNetServer == nil {
+		c.OK = true
+		c.Detail = "not configured, connecting directly"
+		return c
+	}
+
+	lc, err := h.TSNetServer.LocalClient()
+	if err != nil {
+		c.Detail = err.Error()
+		c.Hint = "Check TS_AUTHKEY and that TS_DIR is writable"
+		return c
+	}
+	status, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		c.Detail = err.Error()
+		c.Hint = "Check TS_AUTHKEY and that TS_DIR is writable"
+		return c
+	}
+	c.OK = status.BackendState == "Running"
+	c.Detail = "backend state " + status.BackendState
+	if !c.OK {
+		c.Hint = "The auth key may be expired or revoked, generate a new one in the Tailscale admin console"
+	}
+	return c
+}
+
+func (h *LambdaHandler) checkReachable(ctx context.Context) checkResult {
+	c := checkResult{Name: "ha_reachable"}
+	status, err := h.apiStatus(ctx, "")
+	if err != nil {
+		c.Detail = err.Error()
+		c.Hint = "Check BASE_URL and that Home Assistant is reachable from the tailnet (ACLs, MagicDNS name)"
+		return c
+	}
+	c.OK = true
+	c.Detail = fmt.Sprintf("GET /api/ answered %d", status)
+	return c
+}
+
+func (h *LambdaHandler) checkToken(ctx context.Context) checkResult {
+	c := checkResult{Name: "token_valid"}
+	token, err := h.accessToken(ctx)
+	if err != nil {
+		c.Detail = err.Error()
+		c.Hint = "Log in again to get a new refresh token, with CLIENT_ID set to the client id it was issued for"
+		return c
+	}
+	status, err := h.apiStatus(ctx, token)
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	c.OK = status == http.StatusOK
+	c.Detail = fmt.Sprintf("GET /api/ answered %d", status)
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		c.Hint = "The token is expired or revoked, create a new long-lived access token"
+	}
+	return c
+}
+
+func (h *LambdaHandler) checkSmartHome(ctx context.Context) checkResult {
+	c := checkResult{Name: "smart_home"}
+	event := map[string]interface{}{
+		"directive": map[string]interface{}{
+			"header": map[string]interface{}{
+				"namespace":      "Alexa.Discovery",
+				"name":           "Discover",
+				"payloadVersion": "3",
+				"messageId":      newMessageID(),
+				"timestamp":      time.Now().UTC().Format(time.RFC3339),
+			},
+			"payload": map[string]interface{}{
+				"scope": map[string]interface{}{"type": "BearerToken", "token": "self-test"},
+			},
+		},
+	}
+	response, err := h.selfTestDiscovery(ctx, event)
+	if errors.Is(err, errSelfTestSkipped) {
+		c.OK = true
+		c.Detail = err.Error()
+		return c
+	}
+	if err != nil {
+		c.Detail = err.Error()
+		c.Hint = "Enable the alexa smart_home integration in configuration.yaml"
+		return c
+	}
+	event, _ = response["event"].(map[string]interface{})
+	payload, _ := event["payload"].(map[string]interface{})
+	endpoints, _ := payload["endpoints"].([]interface{})
+	c.OK = true
+	c.Detail = fmt.Sprintf("discovery returned %d endpoints", len(endpoints))
+	return c
+}
+
+// selfTestDiscovery runs the self-test's Discover. With a routing table the
+// made-up scope token resolves to no account, so it goes straight to
+// BASE_URL instead, and is skipped without one.
+func (h *LambdaHandler) selfTestDiscovery(ctx context.Context, event map[string]interface{}) (map[string]interface{}, error) {
+	if h.routes == nil {
+		return h.handle(ctx, event)
+	}
+	if h.BaseURL == "" {
+		return nil, errSelfTestSkipped
+	}
+	info, err := h.parseDirective(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	token, err := h.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.dispatch(ctx, info, upstream{BaseURL: h.BaseURL, Token: token}, event)
+}
+
+// toMap converts a report to the generic shape returned by HandleRequest.
+func (r diagnosticsReport) toMap() map[string]interface{} {
+	data, _ := json.Marshal(r)
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	return m
+}
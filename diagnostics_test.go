@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeHomeAssistant(token string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/":
+			json.NewEncoder(w).Encode(map[string]string{"message": "API running."})
+		case "/api/alexa/smart_home":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"event": map[string]interface{}{
+					"payload": map[string]interface{}{"endpoints": []interface{}{}},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// Test the self-test event against a healthy and a misconfigured instance
+func TestHandleRequest_SelfTest(t *testing.T) {
+	t.Parallel()
+	upstream := fakeHomeAssistant("mock-token")
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "mock-token"})
+	response, err := handler.HandleRequest(context.Background(), map[string]interface{}{"selfTest": true})
+	if err != nil {
+		t.Fatalf("Self-test returned an error: %v", err)
+	}
+	if response["ok"] != true {
+		t.Errorf("Expected a healthy report, got %s", mustJSON(response))
+	}
+	if checks, _ := response["checks"].([]interface{}); len(checks) != 6 {
+		t.Errorf("Expected 6 checks, got %s", mustJSON(response["checks"]))
+	}
+
+	// The replay guard lets every run through
+	handler = newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "mock-token", ReplayWindow: time.Minute, MaxClockSkew: time.Minute})
+	for i := 0; i < 2; i++ {
+		if report := handler.runDiagnostics(context.Background()); !report.OK {
+			t.Errorf("Run %d: expected a healthy report behind the replay guard, got %+v", i, report.Checks)
+		}
+	}
+
+	handler = newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "revoked"})
+	report := handler.runDiagnostics(context.Background())
+	if report.OK {
+		t.Fatal("Expected a failing report with a revoked token")
+	}
+	last := report.Checks[len(report.Checks)-1]
+	if last.Name != "token_valid" || last.Hint == "" {
+		t.Errorf("Expected token_valid to fail with a hint, got %+v", last)
+	}
+}
+
+// Test that the Discover check doesn't go through account resolution when
+// routing
+func TestCheckSmartHome_Routing(t *testing.T) {
+	t.Parallel()
+	upstream := fakeHomeAssistant("mock-token")
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "mock-token"})
+	handler.routes = fileRoutes{}
+	handler.accounts = testAccounts{}
+	if c := handler.checkSmartHome(context.Background()); !c.OK || !strings.Contains(c.Detail, "discovery returned") {
+		t.Errorf("Expected discovery against BASE_URL, got %+v", c)
+	}
+
+	handler.BaseURL = ""
+	if c := handler.checkSmartHome(context.Background()); !c.OK || c.Detail != errSelfTestSkipped.Error() {
+		t.Errorf("Expected the check skipped without BASE_URL, got %+v", c)
+	}
+}
+
+// Test that a self-test writes the composite health metric
+func TestHandleRequest_SelfTestHealthMetric(t *testing.T) {
+	t.Parallel()
+	upstream := fakeHomeAssistant("mock-token")
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{
+		BaseURL:           upstream.URL,
+		LongLivedToken:    "mock-token",
+		SecondaryBaseURL:  upstream.URL,
+		FailoverThreshold: 1,
+		FailoverCooldown:  time.Minute,
+	})
+	var metrics bytes.Buffer
+	handler.metricsOut = &metrics
+
+	handler.HandleRequest(context.Background(), map[string]interface{}{"selfTest": true})
+	handler.failover.observe(false)
+	handler.HandleRequest(context.Background(), map[string]interface{}{"selfTest": true})
+
+	var healthy []float64
+	dec := json.NewDecoder(&metrics)
+	for dec.More() {
+		var line map[string]interface{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		healthy = append(healthy, line["Healthy"].(float64))
+	}
+	if len(healthy) != 2 || healthy[0] != 1 || healthy[1] != 0 {
+		t.Errorf("Expected healthy then unhealthy during failover, got %v", healthy)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// parseUpstreamDial splits UPSTREAM_DIAL, unix:/path/to.sock or host:port,
+// into a network and address.
+func parseUpstreamDial(spec string) (network, address string, ok bool) {
+	if path, isUnix := strings.CutPrefix(spec, "unix:"); isUnix {
+		return "unix", path, path != ""
+	}
+	_, _, err := net.SplitHostPort(spec)
+	return "tcp", spec, err == nil
+}
+
+// dialOverrideClient connects to UPSTREAM_DIAL instead of resolving
+// BASE_URL's host, for a proxy on the same box or pod as Home Assistant.
+// Requests still carry BASE_URL's host in the Host header and for TLS, and
+// requests to other hosts, e.g. SECONDARY_BASE_URL, are dialed as usual.
+func (h *LambdaHandler) dialOverrideClient() *http.Client {
+	network, address, _ := parseUpstreamDial(h.config.UpstreamDial)
+	target := ""
+	if u, err := url.Parse(h.BaseURL); err == nil {
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		target = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var dialer net.Dialer
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, n, addr string) (net.Conn, error) {
+		if addr == target {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return dialer.DialContext(ctx, n, addr)
+	}
+	if !h.VerifySSL {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}
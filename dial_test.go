@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleRequest_UpstreamDial(t *testing.T) {
+	t.Parallel()
+	hass := fakeHomeAssistant("mock-token")
+	defer hass.Close()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "homeassistant.local:8123" {
+			t.Errorf("Expected BASE_URL's host, got %q", r.Host)
+		}
+		hass.Config.Handler.ServeHTTP(w, r)
+	})
+
+	socket := filepath.Join(t.TempDir(), "hass.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Unix sockets unavailable: %v", err)
+	}
+	unix := httptest.NewUnstartedServer(handler)
+	unix.Listener = listener
+	unix.Start()
+	defer unix.Close()
+	tcp := httptest.NewServer(handler)
+	defer tcp.Close()
+
+	for _, dial := range []string{"unix:" + socket, tcp.Listener.Addr().String()} {
+		env := map[string]string{
+			"BASE_URL":                "http://homeassistant.local:8123",
+			"LONG_LIVED_ACCESS_TOKEN": "mock-token",
+			"UPSTREAM_DIAL":           dial,
+		}
+		cfg, err := configFromLookup(func(name string) string { return env[name] })
+		if err != nil {
+			t.Fatalf("%s: invalid configuration: %v", dial, err)
+		}
+		handler := newTestHandler(t, cfg)
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+			t.Errorf("%s: request returned an error: %v", dial, err)
+		}
+	}
+
+	env := map[string]string{"BASE_URL": "http://hass", "UPSTREAM_DIAL": "hass"}
+	if _, err := configFromLookup(func(name string) string { return env[name] }); err == nil {
+		t.Error("Expected UPSTREAM_DIAL without a port to be rejected")
+	}
+}
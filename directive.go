@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Major payloadVersions compatibleVersion warns about at most, as the
+// version comes from the caller.
+const maxVersionWarnings = 8
+
+var (
+	errMissingDirective     = errors.New("malformatted request - missing directive")
+	errUnsupportedVersion   = errors.New("only support payloadVersion == 3")
+	errMissingScope         = errors.New("malformatted request - missing endpoint.scope")
+	errUnsupportedScopeType = errors.New("only support BearerToken")
+)
+
+// directiveInfo holds the fields the handler routes on. It is filled in a
+// single pass so the hot path doesn't repeat map lookups and type assertions.
+type directiveInfo struct {
+	Namespace        string
+	Name             string
+	PayloadVersion   string
+	MessageID        string
+	CorrelationToken string
+	ScopeType        string
+	ScopeToken       string
+	EndpointID       string
+}
+
+func (d directiveInfo) isDiscovery() bool {
+	return d.Namespace == "Alexa.Discovery" && d.Name == "Discover"
+}
+
+func (d directiveInfo) isReportState() bool {
+	return d.Namespace == "Alexa" && d.Name == "ReportState"
+}
+
+// parseDirective validates the envelope of an Alexa directive and extracts
+// its routing fields. It does not allocate on success.
+func (h *LambdaHandler) parseDirective(ctx context.Context, event map[string]interface{}) (directiveInfo, error) {
+	var info directiveInfo
+
+	directive, ok := event["directive"].(map[string]interface{})
+	if !ok {
+		return info, errMissingDirective
+	}
+
+	header, ok := directive["header"].(map[string]interface{})
+	if !ok {
+		return info, errUnsupportedVersion
+	}
+	info.PayloadVersion, _ = header["payloadVersion"].(string)
+	if info.PayloadVersion != "3" {
+		if info.PayloadVersion, ok = h.compatibleVersion(ctx, header["payloadVersion"]); !ok {
+			return info, errUnsupportedVersion
+		}
+	}
+	info.Namespace, _ = header["namespace"].(string)
+	info.Name, _ = header["name"].(string)
+	info.MessageID, _ = header["messageId"].(string)
+	info.CorrelationToken, _ = header["correlationToken"].(string)
+
+	if endpoint, ok := directive["endpoint"].(map[string]interface{}); ok {
+		info.EndpointID, _ = endpoint["endpointId"].(string)
+	}
+
+	scope := h.extractScope(directive)
+	if scope == nil {
+		return info, errMissingScope
+	}
+	info.ScopeType, _ = scope["type"].(string)
+	if info.ScopeType != "BearerToken" {
+		return info, errUnsupportedScopeType
+	}
+	info.ScopeToken, _ = scope["token"].(string)
+
+	return info, nil
+}
+
+// compatibleVersion reports whether PAYLOAD_VERSION_POLICY=lenient accepts a
+// payloadVersion other than "3": a variation of it such as "3.0" or the
+// number 3, or a later version. The first version accepted for each major
+// version is logged, so an Alexa-side bump shows up in the logs instead of
+// failing every directive; at most maxVersionWarnings majors are tracked.
+func (h *LambdaHandler) compatibleVersion(ctx context.Context, raw interface{}) (string, bool) {
+	if h.config.PayloadVersionPolicy != "lenient" {
+		return "", false
+	}
+	var version string
+	switch v := raw.(type) {
+	case string:
+		version = strings.TrimSpace(v)
+	case float64:
+		version = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return "", false
+	}
+	var major int
+	for i, part := range strings.SplitN(version, ".", 2) {
+		n, err := strconv.Atoi(part)
+		if err != nil || (i == 0 && n < 3) {
+			return "", false
+		}
+		if i == 0 {
+			major = n
+		}
+	}
+
+	h.versionMu.Lock()
+	warn := !h.versionWarnings[major] && len(h.versionWarnings) < maxVersionWarnings
+	if warn {
+		if h.versionWarnings == nil {
+			h.versionWarnings = make(map[int]bool)
+		}
+		h.versionWarnings[major] = true
+	}
+	h.versionMu.Unlock()
+	if warn {
+		h.logger(ctx).Sugar().Warnf("Accepting payloadVersion %q under PAYLOAD_VERSION_POLICY=lenient, only 3 is known to work", version)
+	}
+	return version, true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParseDirective(t *testing.T) {
+	t.Parallel()
+	handler := &LambdaHandler{Logger: zap.NewNop()}
+
+	info, err := handler.parseDirective(context.Background(), discoveryEvent())
+	if err != nil {
+		t.Fatalf("parseDirective returned an error: %v", err)
+	}
+	if !info.isDiscovery() {
+		t.Errorf("Expected a discovery directive, got %s.%s", info.Namespace, info.Name)
+	}
+	if info.ScopeToken != "access-token-from-skill" {
+		t.Errorf("Unexpected scope token %q", info.ScopeToken)
+	}
+
+	tests := []struct {
+		name     string
+		event    map[string]interface{}
+		expected error
+	}{
+		{
+			name:     "missing directive",
+			event:    map[string]interface{}{},
+			expected: errMissingDirective,
+		},
+		{
+			name: "wrong payload version",
+			event: map[string]interface{}{
+				"directive": map[string]interface{}{
+					"header": map[string]interface{}{"payloadVersion": "2"},
+				},
+			},
+			expected: errUnsupportedVersion,
+		},
+		{
+			name: "missing scope",
+			event: map[string]interface{}{
+				"directive": map[string]interface{}{
+					"header": map[string]interface{}{"payloadVersion": "3"},
+				},
+			},
+			expected: errMissingScope,
+		},
+		{
+			name: "unsupported scope type",
+			event: map[string]interface{}{
+				"directive": map[string]interface{}{
+					"header": map[string]interface{}{"payloadVersion": "3"},
+					"payload": map[string]interface{}{
+						"scope": map[string]interface{}{"type": "Basic"},
+					},
+				},
+			},
+			expected: errUnsupportedScopeType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := handler.parseDirective(context.Background(), tt.event); err != tt.expected {
+				t.Errorf("Expected error %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+// Routing runs on every invocation and must stay allocation free
+func TestParseDirective_AllocationBudget(t *testing.T) {
+	handler := &LambdaHandler{Logger: zap.NewNop()}
+	event := discoveryEvent()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		info, err := handler.parseDirective(context.Background(), event)
+		if err != nil || !info.isDiscovery() {
+			t.Fatal("unexpected parse result")
+		}
+	})
+	if allocs > 0 {
+		t.Errorf("Expected no allocations, got %.1f per run", allocs)
+	}
+}
+
+func TestExtractScope(t *testing.T) {
+	t.Parallel()
+	bearer := map[string]interface{}{"type": "BearerToken", "token": "t"}
+	handler := newTestHandler(t, Config{BaseURL: "http://localhost", ScopePaths: "payload.auth"})
+	handler.RegisterScopeExtractor(ScopeExtractorFunc(func(directive map[string]interface{}) map[string]interface{} {
+		if token, ok := directive["token"].(string); ok {
+			return map[string]interface{}{"type": "BearerToken", "token": token}
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		name      string
+		directive map[string]interface{}
+		token     interface{}
+	}{
+		{"endpoint.scope", map[string]interface{}{"endpoint": map[string]interface{}{"scope": bearer}}, "t"},
+		{"payload.grantee", map[string]interface{}{"payload": map[string]interface{}{"grantee": bearer}}, "t"},
+		{"SCOPE_PATHS", map[string]interface{}{"payload": map[string]interface{}{"auth": bearer}}, "t"},
+		{"registered", map[string]interface{}{"token": "custom"}, "custom"},
+		{"missing", map[string]interface{}{"payload": map[string]interface{}{}}, nil},
+	}
+	for _, tt := range tests {
+		scope := handler.extractScope(tt.directive)
+		if (scope == nil) != (tt.token == nil) || (scope != nil && scope["token"] != tt.token) {
+			t.Errorf("%s: unexpected scope %v", tt.name, scope)
+		}
+	}
+}
+
+func TestParseDirective_PayloadVersionPolicy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		version interface{}
+		strict  bool
+		lenient bool
+	}{
+		{"3", true, true},
+		{"3.0", false, true},
+		{float64(3), false, true},
+		{"3.1", false, true},
+		{"4", false, true},
+		{"2", false, false},
+		{"v3", false, false},
+		{"", false, false},
+	}
+	for _, policy := range []string{"strict", "lenient"} {
+		handler := &LambdaHandler{Logger: zap.NewNop(), config: Config{PayloadVersionPolicy: policy}}
+		for _, tt := range tests {
+			event := discoveryEvent()
+			event["directive"].(map[string]interface{})["header"].(map[string]interface{})["payloadVersion"] = tt.version
+			_, err := handler.parseDirective(context.Background(), event)
+			want := tt.strict
+			if policy == "lenient" {
+				want = tt.lenient
+			}
+			if (err == nil) != want {
+				t.Errorf("%s: payloadVersion %v: expected accepted %t, got %v", policy, tt.version, want, err)
+			}
+		}
+	}
+}
+
+// Test that lenient payloadVersion warnings are per major version and capped
+func TestCompatibleVersion_Warnings(t *testing.T) {
+	t.Parallel()
+	core, logs := observer.New(zap.WarnLevel)
+	handler := &LambdaHandler{Logger: zap.New(core), config: Config{PayloadVersionPolicy: "lenient"}}
+	for _, version := range []string{"3.0", "3.1", "3.2", "4"} {
+		handler.compatibleVersion(context.Background(), version)
+	}
+	if logs.Len() != 2 {
+		t.Errorf("Expected one warning each for 3.x and 4, got %d", logs.Len())
+	}
+
+	for i := 0; i < 1000; i++ {
+		handler.compatibleVersion(context.Background(), fmt.Sprint(5+i))
+	}
+	if len(handler.versionWarnings) != maxVersionWarnings || logs.Len() != maxVersionWarnings {
+		t.Errorf("Expected %d versions tracked and warned about, got %d and %d", maxVersionWarnings, len(handler.versionWarnings), logs.Len())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// discoveryCache keeps the most recent Discover.Response per Alexa token so
+// repeated discovery requests within the TTL don't reach Home Assistant.
+type discoveryCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]discoveryCacheEntry
+}
+
+type discoveryCacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+func newDiscoveryCache(ttl time.Duration) *discoveryCache {
+	return &discoveryCache{
+		ttl:     ttl,
+		entries: make(map[string]discoveryCacheEntry),
+	}
+}
+
+// get returns a copy of the cached response so callers are free to modify it.
+func (c *discoveryCache) get(token string) (map[string]interface{}, bool) {
+	key := tokenHash(token)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(entry.body, &response); err != nil {
+		return nil, false
+	}
+	return response, true
+}
+
+func (c *discoveryCache) put(token string, response map[string]interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[tokenHash(token)] = discoveryCacheEntry{body: body, expires: now.Add(c.ttl)}
+}
+
+// tokenHash avoids keeping bearer tokens around in memory as map keys.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that repeated discovery with the same token is served from cache
+func TestHandleRequest_DiscoveryCache(t *testing.T) {
+	t.Parallel()
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		json.NewEncoder(w).Encode(map[string]interface{}{"event": map[string]interface{}{}})
+	}))
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{
+		BaseURL:           upstream.URL,
+		DiscoveryCacheTTL: time.Minute,
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+			t.Fatalf("Handler returned an error: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", calls)
+	}
+
+	// A different token is cached separately
+	event := discoveryEvent()
+	scope := event["directive"].(map[string]interface{})["payload"].(map[string]interface{})["scope"].(map[string]interface{})
+	scope["token"] = "another-token"
+	if _, err := handler.HandleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 upstream calls, got %d", calls)
+	}
+}
+
+func TestDiscoveryCache_Expiry(t *testing.T) {
+	t.Parallel()
+	cache := newDiscoveryCache(50 * time.Millisecond)
+	cache.put("token", map[string]interface{}{"event": "cached"})
+
+	if _, ok := cache.get("token"); !ok {
+		t.Fatal("Expected cached response before expiry")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := cache.get("token"); ok {
+		t.Error("Expected cached response to expire")
+	}
+}
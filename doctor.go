@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// doctor runs the same checks as the self-test locally, including joining
+// the tailnet, and prints a checklist. It returns the process exit code.
+func doctor(out io.Writer) int {
+	var checks []checkResult
+	finish := func() int {
+		printChecks(out, checks)
+		for _, c := range checks {
+			if !c.OK {
+				return 1
+			}
+		}
+		return 0
+	}
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		checks = append(checks, checkResult{Name: "config", Detail: err.Error(), Hint: "Fix the environment variable named above"})
+		return finish()
+	}
+	h, err := NewLambdaHandler(cfg, nil)
+	if err != nil {
+		checks = append(checks, checkResult{Name: "config", Detail: err.Error(), Hint: "Set BASE_URL to the URL of your Home Assistant instance"})
+		return finish()
+	}
+
+	authKey := checkResult{Name: "auth_key", OK: true, Detail: "TS_AUTHKEY not set, connecting directly"}
+	if cfg.TSAuthKey != "" {
+		tsNetServer, err := startTailnet(cfg, 30*time.Second)
+		if err != nil {
+			authKey.OK = false
+			authKey.Detail = err.Error()
+			authKey.Hint = "Check that TS_AUTHKEY is valid, not expired and, if single-use, not consumed"
+			checks = append(checks, authKey)
+			return finish()
+		}
+		defer tsNetServer.Close()
+		h.TSNetServer = tsNetServer
+		authKey.Detail = "joined the tailnet"
+	}
+	checks = append(checks, authKey)
+
+	report := h.runDiagnostics(context.Background())
+	checks = append(checks, report.Checks...)
+	return finish()
+}
+
+func printChecks(out io.Writer, checks []checkResult) {
+	for _, c := range checks {
+		mark := " OK "
+		if !c.OK {
+			mark = "FAIL"
+		}
+		fmt.Fprintf(out, "[%s] %-13s %s\n", mark, c.Name, c.Detail)
+		if c.Hint != "" {
+			fmt.Fprintf(out, "       hint: %s\n", c.Hint)
+		}
+	}
+}
+
+// checkPeer verifies that the BASE_URL host is a visible tailnet peer.
+// Hosts outside the tailnet (public names, LAN addresses reached through a
+// subnet router) are reported but not treated as failures.
+func (h *LambdaHandler) checkPeer(ctx context.Context) checkResult {
+	c := checkResult{Name: "ha_peer", OK: true}
+	if h.TSNetServer == nil {
+		c.Detail = "not using the tailnet"
+		return c
+	}
+
+	u, err := url.Parse(h.BaseURL)
+	if err != nil {
+		c.OK = false
+		c.Detail = err.Error()
+		return c
+	}
+	host := u.Hostname()
+
+	lc, err := h.TSNetServer.LocalClient()
+	if err != nil {
+		c.OK = false
+		c.Detail = err.Error()
+		return c
+	}
+	status, err := lc.Status(ctx)
+	if err != nil {
+		c.OK = false
+		c.Detail = err.Error()
+		return c
+	}
+
+	for _, peer := range status.Peer {
+		dnsName := strings.TrimSuffix(peer.DNSName, ".")
+		matched := strings.EqualFold(peer.HostName, host) ||
+			strings.EqualFold(dnsName, host) ||
+			strings.EqualFold(strings.SplitN(dnsName, ".", 2)[0], host)
+		for _, ip := range peer.TailscaleIPs {
+			matched = matched || ip.String() == host
+		}
+		if !matched {
+			continue
+		}
+		c.Detail = fmt.Sprintf("%s is %s", host, peer.HostName)
+		if !peer.Online {
+			c.OK = false
+			c.Detail += ", offline"
+			c.Hint = "Start Tailscale on the Home Assistant host"
+		}
+		return c
+	}
+
+	if ip := net.ParseIP(host); ip != nil && isTailscaleIP(ip) {
+		c.OK = false
+		c.Detail = host + " is not a visible peer"
+		c.Hint = "Check the tailnet ACLs allow this node to reach Home Assistant"
+		return c
+	}
+	c.Detail = host + " is not a tailnet peer, assuming a subnet route or public address"
+	return c
+}
+
+// isTailscaleIP reports whether ip is in the CGNAT range tailnet nodes use.
+func isTailscaleIP(ip net.IP) bool {
+	_, cgnat, _ := net.ParseCIDR("100.64.0.0/10")
+	return cgnat.Contains(ip)
+}
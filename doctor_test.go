@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintChecks(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	printChecks(&out, []checkResult{
+		{Name: "config", OK: true, Detail: "https://hass.example"},
+		{Name: "token_valid", Detail: "GET /api/ answered 401", Hint: "create a new token"},
+	})
+
+	expected := "[ OK ] config        https://hass.example\n" +
+		"[FAIL] token_valid   GET /api/ answered 401\n" +
+		"       hint: create a new token\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
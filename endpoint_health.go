@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Endpoints whose last state is remembered for unreachable reports.
+const maxCachedStates = 1000
+
+// stateCache remembers the last reported context properties per account and
+// endpoint.
+type stateCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedState
+}
+
+type cachedState struct {
+	properties []interface{}
+	reported   time.Time
+	// Prefetched after discovery and not served yet, see warmStates
+	warm bool
+}
+
+func newStateCache() *stateCache {
+	return &stateCache{entries: make(map[string]cachedState)}
+}
+
+func stateKey(info directiveInfo) string {
+	return tokenHash(info.ScopeToken) + "/" + info.EndpointID
+}
+
+func (c *stateCache) put(info directiveInfo, response map[string]interface{}, now time.Time) {
+	c.store(info, response, now, false)
+}
+
+func (c *stateCache) warm(info directiveInfo, response map[string]interface{}, now time.Time) {
+	c.store(info, response, now, true)
+}
+
+func (c *stateCache) store(info directiveInfo, response map[string]interface{}, now time.Time, warm bool) {
+	reportContext, _ := response["context"].(map[string]interface{})
+	properties, ok := reportContext["properties"].([]interface{})
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedStates {
+		// Drop an arbitrary entry, the cache only has to be good enough
+		// for the endpoints in active use
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[stateKey(info)] = cachedState{properties: properties, reported: now, warm: warm}
+}
+
+func (c *stateCache) get(info directiveInfo) (cachedState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.entries[stateKey(info)]
+	return state, ok
+}
+
+// dropWarm stops a warmed state from being served. The properties stay as
+// the last known state for unreachableReport.
+func (c *stateCache) dropWarm(info directiveInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := stateKey(info)
+	if state, ok := c.entries[key]; ok && state.warm {
+		state.warm = false
+		c.entries[key] = state
+	}
+}
+
+// takeWarm returns a warmed state reported after since and marks it served.
+func (c *stateCache) takeWarm(info directiveInfo, since time.Time) (cachedState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := stateKey(info)
+	state, ok := c.entries[key]
+	if !ok || !state.warm || state.reported.Before(since) {
+		return cachedState{}, false
+	}
+	state.warm = false
+	c.entries[key] = state
+	return state, true
+}
+
+// unreachableReport answers a ReportState Home Assistant couldn't with the
+// last known properties and Alexa.EndpointHealth connectivity UNREACHABLE,
+// so the Alexa app shows the device offline instead of an error.
+func (h *LambdaHandler) unreachableReport(ctx context.Context, info directiveInfo, event map[string]interface{}, now time.Time) map[string]interface{} {
+	properties := []interface{}{}
+	if state, ok := h.states.get(info); ok {
+		uncertainty := now.Sub(state.reported).Milliseconds()
+		for _, p := range state.properties {
+			property, ok := p.(map[string]interface{})
+			if !ok || property["namespace"] == "Alexa.EndpointHealth" {
+				continue
+			}
+			stale := make(map[string]interface{}, len(property))
+			for k, v := range property {
+				stale[k] = v
+			}
+			stale["uncertaintyInMilliseconds"] = uncertainty
+			properties = append(properties, stale)
+		}
+	}
+	properties = append(properties, map[string]interface{}{
+		"namespace":                 "Alexa.EndpointHealth",
+		"name":                      "connectivity",
+		"value":                     map[string]interface{}{"value": "UNREACHABLE"},
+		"timeOfSample":              now.UTC().Format(time.RFC3339),
+		"uncertaintyInMilliseconds": 0,
+	})
+	h.logger(ctx).Sugar().Warnf("Reporting endpoint %q as unreachable with %d cached properties", info.EndpointID, len(properties)-1)
+
+	directive, _ := event["directive"].(map[string]interface{})
+	response := map[string]interface{}{
+		"header":  eventHeader(directive, "Alexa", "StateReport"),
+		"payload": map[string]interface{}{},
+	}
+	if endpoint, ok := directive["endpoint"].(map[string]interface{}); ok {
+		response["endpoint"] = endpoint
+	}
+	return map[string]interface{}{
+		"event":   response,
+		"context": map[string]interface{}{"properties": properties},
+	}
+}
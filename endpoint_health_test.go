@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// Test that an unreachable Home Assistant yields an UNREACHABLE state report
+func TestHandleRequest_EndpointHealthFallback(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", EndpointHealthFallback: true})
+	status := http.StatusOK
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(status, `{"event":{"header":{"namespace":"Alexa","name":"StateReport","messageId":"id","payloadVersion":"3"}},
+			"context":{"properties":[{"namespace":"Alexa.PowerController","name":"powerState","value":"ON"}]}}`), nil
+	})
+
+	reportState := func() (map[string]interface{}, error) {
+		event := powerEvent("light#kitchen")
+		header := event["directive"].(map[string]interface{})["header"].(map[string]interface{})
+		header["namespace"], header["name"] = "Alexa", "ReportState"
+		return handler.HandleRequest(context.Background(), event)
+	}
+	if _, err := reportState(); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+
+	status = http.StatusBadGateway
+	response, err := reportState()
+	if err != nil {
+		t.Fatalf("Expected a fallback report, got %v", err)
+	}
+	properties := response["context"].(map[string]interface{})["properties"].([]interface{})
+	if len(properties) != 2 {
+		t.Fatalf("Expected the cached property and connectivity, got %v", properties)
+	}
+	if p := properties[0].(map[string]interface{}); p["name"] != "powerState" || p["value"] != "ON" {
+		t.Errorf("Expected the cached powerState, got %v", p)
+	}
+	health := properties[1].(map[string]interface{})
+	if health["namespace"] != "Alexa.EndpointHealth" || health["value"].(map[string]interface{})["value"] != "UNREACHABLE" {
+		t.Errorf("Expected UNREACHABLE connectivity, got %v", health)
+	}
+
+	// A client error is still an error
+	status = http.StatusUnauthorized
+	if _, err := reportState(); err == nil {
+		t.Error("Expected the 401 to be returned")
+	}
+}
+
+// Test that discovery warms the state of each endpoint for one ReportState
+func TestHandleRequest_WarmStates(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", WarmStates: true})
+	var reports atomic.Int32
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		var event map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&event)
+		header := event["directive"].(map[string]interface{})["header"].(map[string]interface{})
+		if header["name"] == "Discover" {
+			return stubResponse(http.StatusOK, `{"event":{"header":{"namespace":"Alexa.Discovery","name":"Discover.Response"},
+				"payload":{"endpoints":[{"endpointId":"light#kitchen"},{"endpointId":"light#hall"}]}}}`), nil
+		}
+		reports.Add(1)
+		return stubResponse(http.StatusOK, `{"event":{"header":{"namespace":"Alexa","name":"StateReport"}},
+			"context":{"properties":[{"namespace":"Alexa.PowerController","name":"powerState","value":"ON"}]}}`), nil
+	})
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Discovery returned an error: %v", err)
+	}
+	if reports.Load() != 2 {
+		t.Fatalf("Expected both endpoints warmed, got %d state requests", reports.Load())
+	}
+
+	event := powerEvent("light#kitchen")
+	header := event["directive"].(map[string]interface{})["header"].(map[string]interface{})
+	header["namespace"], header["name"] = "Alexa", "ReportState"
+	for i := 0; i < 2; i++ {
+		response, err := handler.HandleRequest(context.Background(), event)
+		if err != nil {
+			t.Fatalf("ReportState %d returned an error: %v", i, err)
+		}
+		if _, ok := response["context"].(map[string]interface{}); !ok {
+			t.Errorf("ReportState %d: expected properties, got %v", i, response)
+		}
+	}
+	if reports.Load() != 3 {
+		t.Errorf("Expected the warmed state served once, got %d state requests", reports.Load())
+	}
+
+	// A change to the endpoint makes its warmed state stale
+	event = powerEvent("light#hall")
+	if _, err := handler.HandleRequest(context.Background(), event); err != nil {
+		t.Fatalf("TurnOn returned an error: %v", err)
+	}
+	header = event["directive"].(map[string]interface{})["header"].(map[string]interface{})
+	header["namespace"], header["name"] = "Alexa", "ReportState"
+	if _, err := handler.HandleRequest(context.Background(), event); err != nil {
+		t.Fatalf("ReportState returned an error: %v", err)
+	}
+	if reports.Load() != 5 {
+		t.Errorf("Expected the state after TurnOn from Home Assistant, got %d state requests", reports.Load())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// entityFilter decides which Home Assistant entities Alexa may see and
+// control. Patterns are globs such as "light.*" or, between slashes,
+// regular expressions such as "/^switch\.(fan|heater)$/". Deny wins over
+// allow, and with an allow list only matching entities pass.
+type entityFilter struct {
+	allow []entityPattern
+	deny  []entityPattern
+}
+
+type entityPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func (p entityPattern) match(entityID string) bool {
+	if p.re != nil {
+		return p.re.MatchString(entityID)
+	}
+	ok, _ := path.Match(p.glob, entityID)
+	return ok
+}
+
+func parseEntityPatterns(name, value string) ([]entityPattern, error) {
+	var patterns []entityPattern
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		switch {
+		case raw == "":
+			continue
+		case len(raw) > 2 && strings.HasPrefix(raw, "/") && strings.HasSuffix(raw, "/"):
+			re, err := regexp.Compile(raw[1 : len(raw)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			patterns = append(patterns, entityPattern{re: re})
+		default:
+			if _, err := path.Match(raw, ""); err != nil {
+				return nil, fmt.Errorf("invalid %s: %q: %w", name, raw, err)
+			}
+			patterns = append(patterns, entityPattern{glob: raw})
+		}
+	}
+	return patterns, nil
+}
+
+// newEntityFilter parses ENTITY_ALLOW and ENTITY_DENY, returning nil when
+// both are empty.
+func newEntityFilter(allow, deny string) (*entityFilter, error) {
+	f := &entityFilter{}
+	var err error
+	if f.allow, err = parseEntityPatterns("ENTITY_ALLOW", allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseEntityPatterns("ENTITY_DENY", deny); err != nil {
+		return nil, err
+	}
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// entityID recovers the entity from an endpointId. Home Assistant uses the
+// entity id with "." replaced by "#"; a backend prefix from aggregation is
+// dropped.
+func entityID(endpointID string) string {
+	if i := strings.Index(endpointID, endpointSeparator); i >= 0 {
+		endpointID = endpointID[i+1:]
+	}
+	return strings.Replace(endpointID, "#", ".", 1)
+}
+
+func (f *entityFilter) allowed(endpointID string) bool {
+	id := entityID(endpointID)
+	for _, p := range f.deny {
+		if p.match(id) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.match(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterDiscovery removes filtered endpoints from a Discover.Response.
+func (h *LambdaHandler) filterDiscovery(ctx context.Context, response map[string]interface{}) {
+	payload := responsePayload(response)
+	endpoints, ok := payload["endpoints"].([]interface{})
+	if !ok {
+		return
+	}
+	kept := endpoints[:0]
+	for _, e := range endpoints {
+		endpoint, _ := e.(map[string]interface{})
+		if id, ok := endpoint["endpointId"].(string); ok && !h.entities.allowed(id) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if removed := len(endpoints) - len(kept); removed > 0 {
+		h.logger(ctx).Sugar().Infof("Filtered %d of %d discovered endpoints", removed, len(endpoints))
+	}
+	payload["endpoints"] = kept
+}
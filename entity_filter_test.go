@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestEntityFilter(t *testing.T) {
+	t.Parallel()
+	filter, err := newEntityFilter("light.*, /^switch\\.(fan|heater)$/", "light.garage*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"light#kitchen":       true,
+		"house:light#kitchen": true,
+		"light#garage_door":   false,
+		"switch#fan":          true,
+		"switch#fan_2":        false,
+		"lock#front_door":     false,
+	}
+	for endpointID, expected := range tests {
+		if got := filter.allowed(endpointID); got != expected {
+			t.Errorf("allowed(%q) = %v, expected %v", endpointID, got, expected)
+		}
+	}
+
+	if _, err := newEntityFilter("/(/", ""); err == nil {
+		t.Error("Expected an invalid regular expression to be rejected")
+	}
+}
+
+// Test that filtered entities are hidden from discovery and refused
+func TestHandleRequest_EntityFilter(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", EntityDeny: "lock.*"})
+	calls := 0
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		calls++
+		return stubResponse(http.StatusOK, `{"event":{"payload":{"endpoints":[{"endpointId":"light#hall"},{"endpointId":"lock#front_door"}]}}}`), nil
+	})
+
+	response, err := handler.HandleRequest(context.Background(), discoveryEvent())
+	if err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if endpoints := responsePayload(response)["endpoints"].([]interface{}); len(endpoints) != 1 {
+		t.Errorf("Expected the lock to be filtered, got %v", endpoints)
+	}
+
+	response, err = handler.HandleRequest(context.Background(), powerEvent("lock#front_door"))
+	if err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if calls != 1 || responsePayload(response)["type"] != "NO_SUCH_ENDPOINT" {
+		t.Errorf("Expected NO_SUCH_ENDPOINT without an upstream call, got %v after %d calls", response, calls)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Envelope checks are a minimal sanity check of Alexa messages, not the
+// official Alexa Smart Home message schema: a few hand-written rules for
+// headers, endpoints, context properties and discovery endpoints, in the
+// subset of JSON Schema below (type, required, properties, items, enum,
+// minLength, pattern). Interface payloads aren't checked, and the directive's
+// payloadVersion is left to PAYLOAD_VERSION_POLICY.
+//
+//go:embed envelope
+var envelopeFiles embed.FS
+
+type jsonSchema struct {
+	Type       string                 `json:"type"`
+	Required   []string               `json:"required"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Items      *jsonSchema            `json:"items"`
+	Enum       []interface{}          `json:"enum"`
+	MinLength  int                    `json:"minLength"`
+	Pattern    string                 `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+// envelopeChecker checks directives and responses against the rules in
+// envelope/.
+type envelopeChecker struct {
+	directive *jsonSchema
+	response  *jsonSchema
+}
+
+func newEnvelopeChecker() (*envelopeChecker, error) {
+	directive, err := loadSchema("envelope/directive.json")
+	if err != nil {
+		return nil, err
+	}
+	response, err := loadSchema("envelope/response.json")
+	if err != nil {
+		return nil, err
+	}
+	return &envelopeChecker{directive: directive, response: response}, nil
+}
+
+func loadSchema(name string) (*jsonSchema, error) {
+	data, err := envelopeFiles.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := s.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &s, nil
+}
+
+func (s *jsonSchema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	}
+	for _, prop := range s.Properties {
+		if err := prop.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// validate returns a description of every violation found in v.
+func (s *jsonSchema) validate(path string, v interface{}) []string {
+	var violations []string
+
+	if s.Type != "" && !hasType(v, s.Type) {
+		return append(violations, fmt.Sprintf("%s: expected %s", path, s.Type))
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if v == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("%s: %v is not one of %v", path, v, s.Enum))
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		if len(v) < s.MinLength {
+			violations = append(violations, fmt.Sprintf("%s: shorter than %d", path, s.MinLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			violations = append(violations, fmt.Sprintf("%s: does not match %s", path, s.Pattern))
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				violations = append(violations, fmt.Sprintf("%s.%s: required", path, name))
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, ok := v[name]; ok {
+				violations = append(violations, s.Properties[name].validate(path+"."+name, value)...)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				violations = append(violations, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+	}
+	return violations
+}
+
+func hasType(v interface{}, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	}
+	return true
+}
+
+// checkDirective and checkResponse normalize v through JSON first so
+// typed Go values validate the same way decoded ones do.
+func (sv *envelopeChecker) checkDirective(event map[string]interface{}) []string {
+	return sv.directive.validate("$", normalizeJSON(event))
+}
+
+func (sv *envelopeChecker) checkResponse(response map[string]interface{}) []string {
+	return sv.response.validate("$", normalizeJSON(response))
+}
+
+func normalizeJSON(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	json.Unmarshal(data, &out)
+	return out
+}
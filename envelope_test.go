@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MrwanBaghdad/hass-tailscale-lambda/golden"
+)
+
+func TestEnvelopeChecker(t *testing.T) {
+	t.Parallel()
+	sv, err := newEnvelopeChecker()
+	if err != nil {
+		t.Fatalf("Failed to load envelope checks: %v", err)
+	}
+
+	if violations := sv.checkDirective(discoveryEvent()); len(violations) != 0 {
+		t.Errorf("Expected a valid directive, got %v", violations)
+	}
+
+	// Which versions are accepted is up to PAYLOAD_VERSION_POLICY
+	event := discoveryEvent()
+	event["directive"].(map[string]interface{})["header"].(map[string]interface{})["payloadVersion"] = "3.0"
+	if violations := sv.checkDirective(event); len(violations) != 0 {
+		t.Errorf("Expected no violations for payloadVersion 3.0, got %v", violations)
+	}
+
+	event = discoveryEvent()
+	delete(event["directive"].(map[string]interface{})["header"].(map[string]interface{}), "messageId")
+	violations := sv.checkDirective(event)
+	if len(violations) != 1 || violations[0] != "$.directive.header.messageId: required" {
+		t.Errorf("Expected missing messageId, got %v", violations)
+	}
+
+	response := map[string]interface{}{
+		"event": map[string]interface{}{
+			"header": map[string]interface{}{
+				"namespace":      "Alexa.Discovery",
+				"name":           "Discover.Response",
+				"payloadVersion": "3",
+			},
+			"payload": map[string]interface{}{
+				"endpoints": []interface{}{
+					map[string]interface{}{"endpointId": "light living room"},
+				},
+			},
+		},
+	}
+	violations = sv.checkResponse(response)
+	joined := strings.Join(violations, "\n")
+	for _, expected := range []string{
+		"$.event.header.messageId: required",
+		"$.event.payload.endpoints[0].friendlyName: required",
+		"$.event.payload.endpoints[0].endpointId: does not match",
+	} {
+		if !strings.Contains(joined, expected) {
+			t.Errorf("Expected violation %q in:\n%s", expected, joined)
+		}
+	}
+}
+
+// Golden directives are real Alexa directives and must pass the checks.
+// Golden responses are cut down to what the mapping tests need, so they
+// aren't checked.
+func TestEnvelopeChecker_GoldenDirectives(t *testing.T) {
+	t.Parallel()
+	sv, err := newEnvelopeChecker()
+	if err != nil {
+		t.Fatalf("Failed to load envelope checks: %v", err)
+	}
+	cases, err := golden.Load("testdata/golden")
+	if err != nil {
+		t.Fatalf("Failed to load fixtures: %v", err)
+	}
+
+	for _, c := range cases {
+		if violations := sv.checkDirective(c.In.Event); len(violations) != 0 && c.Out.Error == "" {
+			t.Errorf("%s: directive violations %v", c.Name, violations)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MrwanBaghdad/hass-tailscale-lambda/retry"
+)
+
+// errUpstreamUnavailable is returned when Home Assistant could not be reached
+// at all.
+var errUpstreamUnavailable error = unavailableError{}
+
+// unavailableError keeps the transport error behind errUpstreamUnavailable
+// for retry.Classify, e.g. to tell the caller's deadline from a dial
+// failure, without showing it to the caller.
+type unavailableError struct {
+	cause error
+}
+
+// upstreamUnavailable wraps a transport error as errUpstreamUnavailable.
+func upstreamUnavailable(cause error) error { return unavailableError{cause: cause} }
+
+func (unavailableError) Error() string { return "internal server error" }
+
+func (e unavailableError) Unwrap() error { return e.cause }
+
+func (unavailableError) Is(target error) bool {
+	_, ok := target.(unavailableError)
+	return ok
+}
+
+// Unreachable marks the error for retry.Classify.
+func (unavailableError) Unreachable() bool { return true }
+
+// statusError is an error status returned by Home Assistant.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status code: %d", e.code)
+}
+
+// StatusCode exposes the status to retry.Classify.
+func (e *statusError) StatusCode() int { return e.code }
+
+// failover switches directives for BASE_URL to a standby instance after
+// threshold consecutive failures of the primary, and back once cooldown has
+// passed or the primary is seen healthy again.
+type failover struct {
+	secondary upstream
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	until    time.Time
+}
+
+func newFailover(cfg Config) *failover {
+	if cfg.SecondaryBaseURL == "" {
+		return nil
+	}
+	return &failover{
+		// Without a token of its own, see forwardStandby
+		secondary: upstream{BaseURL: strings.TrimRight(cfg.SecondaryBaseURL, "/"), Token: cfg.SecondaryToken},
+		threshold: cfg.FailoverThreshold,
+		cooldown:  cfg.FailoverCooldown,
+	}
+}
+
+// active reports whether the primary is currently considered down.
+func (f *failover) active() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Now().Before(f.until)
+}
+
+// observe feeds a health signal from the primary into the failover state and
+// reports whether it just switched to the secondary.
+func (f *failover) observe(healthy bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if healthy {
+		f.failures = 0
+		f.until = time.Time{}
+		return false
+	}
+	f.failures++
+	if f.failures < f.threshold {
+		return false
+	}
+	f.failures = 0
+	f.until = time.Now().Add(f.cooldown)
+	return true
+}
+
+// unhealthy reports whether err from the primary counts against it. Client
+// errors such as a rejected token would fail on the standby too, and
+// throttling says the instance is up.
+func unhealthy(err error) bool {
+	switch retry.Classify(err) {
+	case retry.Network, retry.ServerError:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a directive that failed with err may be sent to
+// another instance: it has no side effects, or it was never written.
+func retryable(info directiveInfo, err error) bool {
+	return info.isReadOnly() || notSent(err)
+}
+
+// notSent reports whether err happened before the request went out, while
+// resolving or dialing the upstream.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// forwardStandby forwards to the secondary or shadow instance, with the
+// primary's current access token unless it has a token of its own. That is
+// the long-lived token or one exchanged for REFRESH_TOKEN, so a standby
+// restored from the primary's backup accepts it.
+func (h *LambdaHandler) forwardStandby(ctx context.Context, target upstream, body []byte) (map[string]interface{}, error) {
+	if target.Token == "" {
+		token, err := h.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		target.Token = token
+	}
+	return h.forward(ctx, target, body)
+}
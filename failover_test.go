@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test that a failing primary is retried on the secondary and then skipped
+func TestHandleRequest_Failover(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:           "http://primary.example",
+		LongLivedToken:    "token",
+		SecondaryBaseURL:  "http://secondary.example/",
+		FailoverThreshold: 2,
+		FailoverCooldown:  time.Minute,
+	})
+	primaryStatus := http.StatusServiceUnavailable
+	primaryCalls := 0
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "primary.example" {
+			primaryCalls++
+			return stubResponse(primaryStatus, ""), nil
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Expected the primary token on the secondary, got %q", got)
+		}
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+			t.Fatalf("Request %d returned an error: %v", i, err)
+		}
+	}
+	if primaryCalls != 2 {
+		t.Errorf("Expected the primary to be skipped after 2 failures, got %d calls", primaryCalls)
+	}
+
+	// Client errors are not a reason to fail over
+	handler.failover.observe(true)
+	primaryStatus = http.StatusUnauthorized
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err == nil || err.Error() != "status code: 401" {
+		t.Errorf("Expected the primary's 401, got %v", err)
+	}
+}
+
+// Test that the caller's deadline neither counts against the primary nor is
+// retried on the secondary
+func TestHandleRequest_FailoverDeadline(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:           "http://primary.example",
+		LongLivedToken:    "token",
+		SecondaryBaseURL:  "http://secondary.example",
+		FailoverThreshold: 1,
+		FailoverCooldown:  time.Minute,
+	})
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host != "primary.example" {
+			t.Errorf("Unexpected request to %s", req.URL.Host)
+		}
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := handler.HandleRequest(ctx, discoveryEvent())
+	if !errors.Is(err, errUpstreamUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected errUpstreamUnavailable caused by the deadline, got %v", err)
+	}
+	if handler.failover.active() {
+		t.Error("Expected the deadline not to trip failover")
+	}
+}
+
+// Test that a directive with side effects only goes to the secondary if the
+// primary never received it
+func TestHandleRequest_FailoverNotReadOnly(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:           "http://primary.example",
+		LongLivedToken:    "token",
+		SecondaryBaseURL:  "http://secondary.example",
+		FailoverThreshold: 10,
+		FailoverCooldown:  time.Minute,
+	})
+	var primaryErr error
+	secondaryCalls := 0
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "primary.example" {
+			if primaryErr != nil {
+				return nil, primaryErr
+			}
+			return stubResponse(http.StatusBadGateway, ""), nil
+		}
+		secondaryCalls++
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+
+	if _, err := handler.HandleRequest(context.Background(), powerEvent("light#kitchen")); err == nil {
+		t.Error("Expected the primary's 502")
+	}
+	if secondaryCalls != 0 {
+		t.Errorf("Expected TurnOn not to be resent after reaching the primary, got %d secondary calls", secondaryCalls)
+	}
+
+	primaryErr = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	if _, err := handler.HandleRequest(context.Background(), powerEvent("light#kitchen")); err != nil {
+		t.Errorf("Request returned an error: %v", err)
+	}
+	if secondaryCalls != 1 {
+		t.Errorf("Expected TurnOn to go to the secondary after a dial failure, got %d calls", secondaryCalls)
+	}
+}
+
+// Test that with only REFRESH_TOKEN set the secondary gets the exchanged token
+func TestHandleRequest_FailoverRefreshToken(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:           "http://primary.example",
+		RefreshToken:      "refresh",
+		SecondaryBaseURL:  "http://secondary.example",
+		FailoverThreshold: 3,
+		FailoverCooldown:  time.Minute,
+	})
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.URL.Path == "/auth/token":
+			return stubResponse(http.StatusOK, `{"access_token":"short-lived","expires_in":1800}`), nil
+		case req.URL.Host == "primary.example":
+			return stubResponse(http.StatusServiceUnavailable, ""), nil
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer short-lived" {
+			t.Errorf("Expected the exchanged token on the secondary, got %q", got)
+		}
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Errorf("Request returned an error: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// Malformed directives must never panic and must either produce a response
+// or a non-empty error.
+func FuzzHandleRequest(f *testing.F) {
+	seeds, _ := filepath.Glob("testdata/golden/*.in.json")
+	for _, path := range seeds {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		var in struct {
+			Event json.RawMessage `json:"event"`
+		}
+		if err := json.Unmarshal(data, &in); err != nil {
+			f.Fatal(err)
+		}
+		f.Add([]byte(in.Event))
+	}
+	f.Add([]byte(`{"directive":{"header":{"payloadVersion":3}}}`))
+	f.Add([]byte(`{"directive":{"header":{"payloadVersion":"3"},"payload":{"scope":"BearerToken"}}}`))
+	f.Add([]byte(`{"directive":[]}`))
+
+	handler := &LambdaHandler{
+		BaseURL: "http://hass.example",
+		Logger:  zap.NewNop(),
+		HTTPClient: doerFunc(func(*http.Request) (*http.Response, error) {
+			return stubResponse(http.StatusOK, `{"event":{}}`), nil
+		}),
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var event map[string]interface{}
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Skip()
+		}
+
+		response, err := handler.HandleRequest(context.Background(), event)
+		if err != nil {
+			if err.Error() == "" {
+				t.Error("Expected a descriptive error")
+			}
+			return
+		}
+		if response == nil {
+			t.Error("Expected a response when no error is returned")
+		}
+	})
+}
@@ -0,0 +1,110 @@
+// Package golden loads fixture pairs describing how the proxy maps an Alexa
+// directive to a Home Assistant request and what it returns to Alexa.
+//
+// Each case is a pair of files in one directory:
+//
+//	<name>.in.json   the event and the stubbed upstream reply
+//	<name>.out.json  the expected upstream request, response or error
+//
+// Downstream users can point Load at their own directory to extend the suite.
+package golden
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	inSuffix  = ".in.json"
+	outSuffix = ".out.json"
+)
+
+// Case is a single directive fixture.
+type Case struct {
+	Name string `json:"-"`
+	In   Input  `json:"-"`
+	Out  Output `json:"-"`
+	// OutPath is where the expected output was read from, so tests can
+	// rewrite it when regenerating fixtures.
+	OutPath string `json:"-"`
+}
+
+// Input is the content of a .in.json file.
+type Input struct {
+	Event    map[string]interface{} `json:"event"`
+	Upstream Upstream               `json:"upstream"`
+}
+
+// Upstream is the stubbed Home Assistant reply.
+type Upstream struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Output is the content of a .out.json file.
+type Output struct {
+	Request  *Request               `json:"request,omitempty"`
+	Response map[string]interface{} `json:"response,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// Request is the HTTP request the proxy is expected to send upstream. Only
+// the headers listed are compared.
+type Request struct {
+	Method  string                 `json:"method"`
+	Path    string                 `json:"path"`
+	Headers map[string]string      `json:"headers,omitempty"`
+	Body    map[string]interface{} `json:"body,omitempty"`
+}
+
+// Load reads every fixture pair in dir, sorted by name. An input without a
+// matching output is loaded with an empty Output.
+func Load(dir string) ([]Case, error) {
+	inputs, err := filepath.Glob(filepath.Join(dir, "*"+inSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(inputs)
+
+	cases := make([]Case, 0, len(inputs))
+	for _, inPath := range inputs {
+		name := strings.TrimSuffix(filepath.Base(inPath), inSuffix)
+		c := Case{
+			Name:    name,
+			OutPath: filepath.Join(dir, name+outSuffix),
+		}
+
+		if err := readJSON(inPath, &c.In); err != nil {
+			return nil, err
+		}
+		if err := readJSON(c.OutPath, &c.Out); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+// WriteOutput stores out as the expected output of c.
+func WriteOutput(c Case, out Output) error {
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.OutPath, append(data, '\n'), 0o644)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
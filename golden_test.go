@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/MrwanBaghdad/hass-tailscale-lambda/golden"
+)
+
+var update = flag.Bool("update", false, "rewrite golden .out.json files")
+
+// Golden headers compared on the upstream request
+var goldenHeaders = []string{"Authorization", "Content-Type"}
+
+func TestGolden(t *testing.T) {
+	t.Parallel()
+	cases, err := golden.Load("testdata/golden")
+	if err != nil {
+		t.Fatalf("Failed to load fixtures: %v", err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("No fixtures found")
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			handler := newTestHandler(t, Config{
+				BaseURL:        "http://hass.example",
+				LongLivedToken: "mock-token",
+			})
+
+			var got golden.Output
+			handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+				got.Request = captureRequest(t, req)
+				return stubResponse(c.In.Upstream.Status, string(c.In.Upstream.Body)), nil
+			})
+
+			response, err := handler.HandleRequest(context.Background(), c.In.Event)
+			got.Response = response
+			if err != nil {
+				got.Error = err.Error()
+			}
+
+			if *update {
+				if err := golden.WriteOutput(c, got); err != nil {
+					t.Fatalf("Failed to update %s: %v", c.OutPath, err)
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(normalize(t, got.Request), normalize(t, c.Out.Request)) {
+				t.Errorf("Upstream request mismatch\n got: %s\nwant: %s", mustJSON(got.Request), mustJSON(c.Out.Request))
+			}
+			if !reflect.DeepEqual(normalize(t, got.Response), normalize(t, c.Out.Response)) {
+				t.Errorf("Response mismatch\n got: %s\nwant: %s", mustJSON(got.Response), mustJSON(c.Out.Response))
+			}
+			if got.Error != c.Out.Error {
+				t.Errorf("Expected error %q, got %q", c.Out.Error, got.Error)
+			}
+		})
+	}
+}
+
+func captureRequest(t *testing.T, req *http.Request) *golden.Request {
+	captured := &golden.Request{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Headers: make(map[string]string),
+	}
+	for _, name := range goldenHeaders {
+		if v := req.Header.Get(name); v != "" {
+			captured.Headers[name] = v
+		}
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("Failed to read request body: %v", err)
+	}
+	if err := json.Unmarshal(body, &captured.Body); err != nil {
+		t.Fatalf("Upstream request body is not JSON: %v", err)
+	}
+	return captured
+}
+
+// normalize round-trips v through JSON so typed values compare equal to
+// values decoded from fixtures.
+func normalize(t *testing.T, v interface{}) interface{} {
+	var out interface{}
+	if err := json.Unmarshal(mustJSON(v), &out); err != nil {
+		t.Fatalf("Failed to normalize: %v", err)
+	}
+	return out
+}
+
+func mustJSON(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errRefreshRejected = errors.New("refresh token revoked or issued for another client id")
+
+// accessToken returns the token for BASE_URL: LONG_LIVED_ACCESS_TOKEN, or
+// with REFRESH_TOKEN an access token exchanged for it, cached until shortly
+// before it expires (30 minutes by default in Home Assistant).
+func (h *LambdaHandler) accessToken(ctx context.Context) (string, error) {
+	if h.config.RefreshToken == "" {
+		return h.LongLivedToken, nil
+	}
+	return h.tokens.fetch(ctx, "refresh:"+h.config.RefreshToken, h.refreshAccessToken)
+}
+
+// refreshAccessToken exchanges REFRESH_TOKEN at Home Assistant's auth API.
+func (h *LambdaHandler) refreshAccessToken(ctx context.Context) (string, time.Time, error) {
+	clientID := h.config.ClientID
+	if clientID == "" {
+		// The client id of the Home Assistant frontend, whose logins issue
+		// refresh tokens
+		clientID = h.BaseURL + "/"
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"refresh_token": {h.config.RefreshToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.BaseURL+"/auth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := h.httpClient().Do(req)
+	if err != nil {
+		h.logger(ctx).Sugar().Errorf("Error refreshing the access token: %v", err)
+		return "", time.Time{}, upstreamUnavailable(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		h.logger(ctx).Sugar().Errorf("REFRESH_TOKEN was rejected by Home Assistant (status code: %d): %s", resp.StatusCode, body)
+		return "", time.Time{}, errRefreshRejected
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, &statusError{code: resp.StatusCode}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("invalid token response: %v", err)
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
@@ -0,0 +1,149 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// Test discovery and control against a real Home Assistant, see
+// integration/README.md
+func TestIntegration_DiscoveryAndControl(t *testing.T) {
+	baseURL := os.Getenv("HASS_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8123"
+	}
+	token := os.Getenv("HASS_TOKEN")
+	if token == "" {
+		token = onboard(t, baseURL)
+	}
+
+	var tsNetServer *tsnet.Server
+	if key := os.Getenv("TS_AUTHKEY"); key != "" {
+		tsNetServer = &tsnet.Server{
+			AuthKey:    key,
+			ControlURL: os.Getenv("TS_CONTROL_URL"),
+			Ephemeral:  true,
+			Hostname:   "hass-lambda-integration",
+			Dir:        t.TempDir(),
+		}
+		defer tsNetServer.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := tsNetServer.Up(ctx); err != nil {
+			t.Fatalf("Failed to connect to tailnet: %v", err)
+		}
+	}
+
+	handler, err := NewLambdaHandler(Config{BaseURL: baseURL, LongLivedToken: token}, tsNetServer)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	response, err := handler.HandleRequest(context.Background(), discoveryEvent())
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	if !strings.Contains(string(mustJSON(response)), `"endpointId":"input_boolean#kitchen"`) {
+		t.Fatalf("Expected input_boolean#kitchen in discovery response: %s", mustJSON(response))
+	}
+
+	response, err = handler.HandleRequest(context.Background(), endpointEvent("Alexa.PowerController", "TurnOn", "input_boolean#kitchen"))
+	if err != nil {
+		t.Fatalf("TurnOn failed: %v", err)
+	}
+	if name := responseHeader(response)["name"]; name != "Response" {
+		t.Fatalf("Expected Response to TurnOn, got %v: %s", name, mustJSON(response))
+	}
+
+	response, err = handler.HandleRequest(context.Background(), endpointEvent("Alexa", "ReportState", "input_boolean#kitchen"))
+	if err != nil {
+		t.Fatalf("ReportState failed: %v", err)
+	}
+	if !strings.Contains(string(mustJSON(response)), `"value":"ON"`) {
+		t.Errorf("Expected powerState ON after TurnOn: %s", mustJSON(response))
+	}
+}
+
+func endpointEvent(namespace, name, endpointID string) map[string]interface{} {
+	return map[string]interface{}{
+		"directive": map[string]interface{}{
+			"header": map[string]interface{}{
+				"namespace":        namespace,
+				"name":             name,
+				"payloadVersion":   "3",
+				"messageId":        "integration-" + name,
+				"correlationToken": "integration-correlation-token",
+			},
+			"endpoint": map[string]interface{}{
+				"scope": map[string]interface{}{
+					"type":  "BearerToken",
+					"token": "access-token-from-skill",
+				},
+				"endpointId": endpointID,
+			},
+			"payload": map[string]interface{}{},
+		},
+	}
+}
+
+func responseHeader(response map[string]interface{}) map[string]interface{} {
+	event, _ := response["event"].(map[string]interface{})
+	header, _ := event["header"].(map[string]interface{})
+	return header
+}
+
+// onboard creates the owner account on a fresh Home Assistant and exchanges
+// the resulting auth code for an access token.
+func onboard(t *testing.T, baseURL string) string {
+	clientID := baseURL + "/"
+	body, _ := json.Marshal(map[string]string{
+		"client_id": clientID,
+		"name":      "Integration",
+		"username":  "integration",
+		"password":  "integration-password",
+		"language":  "en",
+	})
+	resp, err := http.Post(baseURL+"/api/onboarding/users", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Onboarding failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Onboarding failed with status %d, set HASS_TOKEN for an onboarded instance", resp.StatusCode)
+	}
+	var user struct {
+		AuthCode string `json:"auth_code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatalf("Failed to decode onboarding response: %v", err)
+	}
+
+	resp, err = http.PostForm(baseURL+"/auth/token", url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {user.AuthCode},
+		"client_id":  {clientID},
+	})
+	if err != nil {
+		t.Fatalf("Token exchange failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.AccessToken == "" {
+		t.Fatalf("Failed to decode token response: %v", err)
+	}
+	return tokens.AccessToken
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// keepalive periodically pings Home Assistant so the tailnet path (NAT
+// mappings, DERP session and pooled connections) stays warm between directives.
+func (h *LambdaHandler) keepalive(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := h.ping(ctx)
+			if ctx.Err() != nil {
+				// Stopped mid-ping, which says nothing about the primary
+				return
+			}
+			if err != nil {
+				h.Logger.Sugar().Warnf("Keepalive failed: %v", err)
+				h.reloginIfNeeded(ctx)
+			}
+			// Like send, only unavailability counts against the primary;
+			// a rejected token would fail on the secondary too
+			if h.failover != nil && h.failover.observe(!unhealthy(err)) {
+				h.Logger.Sugar().Warnf("Primary failed %d keepalives in a row, using the secondary", h.failover.threshold)
+			}
+		}
+	}
+}
+
+// ping issues a lightweight authenticated request against the HA API root.
+func (h *LambdaHandler) ping(ctx context.Context) error {
+	token, err := h.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := h.apiStatus(ctx, token)
+	if err != nil {
+		return err
+	}
+	if status >= 400 {
+		return &statusError{code: status}
+	}
+	return nil
+}
+
+// apiStatus requests the HA API root with token, or unauthenticated when
+// token is empty, and returns the status code.
+func (h *LambdaHandler) apiStatus(ctx context.Context, token string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/", h.BaseURL), nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	resp, err := h.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection goes back to the pool
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	t.Parallel()
+	pings := make(chan string, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings <- r.URL.Path + " " + r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{
+		BaseURL:        upstream.URL,
+		LongLivedToken: "mock-token",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		handler.keepalive(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case got := <-pings:
+		if got != "/api/ Bearer mock-token" {
+			t.Errorf("Unexpected keepalive request: %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a keepalive request")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected keepalive to stop with its context")
+	}
+}
+
+// Test that keepalives warm the connection the next directive uses
+func TestKeepalive_SharesConnection(t *testing.T) {
+	t.Parallel()
+	hass := fakeHomeAssistant("mock-token")
+	defer hass.Close()
+	var dials atomic.Int32
+	upstream := httptest.NewUnstartedServer(hass.Config.Handler)
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	// Without SSL verification each client used to get a transport of its own
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "mock-token", NotVerifySSL: true})
+	if err := handler.ping(context.Background()); err != nil {
+		t.Fatalf("Keepalive failed: %v", err)
+	}
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if dials.Load() != 1 {
+		t.Errorf("Expected one connection for the keepalive and directive, got %d", dials.Load())
+	}
+}
+
+// Test that only an unreachable primary counts towards failover
+func TestKeepalive_Failover(t *testing.T) {
+	t.Parallel()
+	rejecting := fakeHomeAssistant("other-token")
+	defer rejecting.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	for _, tt := range []struct {
+		baseURL string
+		active  bool
+	}{
+		{rejecting.URL, false},
+		{unreachable.URL, true},
+	} {
+		handler := newTestHandler(t, Config{
+			BaseURL:           tt.baseURL,
+			LongLivedToken:    "mock-token",
+			SecondaryBaseURL:  "http://secondary.example",
+			FailoverThreshold: 2,
+			FailoverCooldown:  time.Minute,
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		handler.keepalive(ctx, 10*time.Millisecond)
+		cancel()
+		if got := handler.failover.active(); got != tt.active {
+			t.Errorf("%s: expected failover active %v, got %v", tt.baseURL, tt.active, got)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newLogger builds the logger for cfg. The console format is meant for local
+// runs: colored levels, short timestamps and no stack traces on warnings.
+func newLogger(cfg Config) (*zap.Logger, error) {
+	switch cfg.LogFormat {
+	case "console":
+		zcfg := zap.NewDevelopmentConfig()
+		zcfg.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		zcfg.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout("15:04:05.000")
+		zcfg.DisableStacktrace = true
+		if !cfg.Debug {
+			zcfg.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+		}
+		return zcfg.Build()
+	case "json":
+		zcfg := zap.NewProductionConfig()
+		if cfg.Debug {
+			zcfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+		}
+		return zcfg.Build()
+	case "":
+		if cfg.Debug {
+			return zap.NewDevelopment()
+		}
+		return zap.NewProduction()
+	default:
+		return nil, fmt.Errorf("unknown LOG_FORMAT %q", cfg.LogFormat)
+	}
+}
+
+type loggerKey struct{}
+
+// withLogger returns ctx carrying a request-scoped logger.
+func withLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFromContext returns the logger in ctx, or nil.
+func loggerFromContext(ctx context.Context) *zap.Logger {
+	logger, _ := ctx.Value(loggerKey{}).(*zap.Logger)
+	return logger
+}
+
+// logger returns the request-scoped logger in ctx, falling back to the
+// handler's, tagged with the tenant of the request once it is known. Code
+// that handles a request logs through it so concurrent requests in server
+// mode can be told apart.
+func (h *LambdaHandler) logger(ctx context.Context) *zap.Logger {
+	logger := loggerFromContext(ctx)
+	if logger == nil {
+		logger = h.Logger
+	}
+	if scope := scopeFrom(ctx); scope != nil && scope.tenant != "" {
+		return logger.With(zap.String("tenant", scope.tenant))
+	}
+	return logger
+}
+
+// requestLogger tags the handler's logger with the messageId of event and
+// whether this is the first invocation of the process.
+func (h *LambdaHandler) requestLogger(event map[string]interface{}) *zap.Logger {
+	fields := []zap.Field{zap.Bool("coldStart", h.invocations.Add(1) == 1)}
+	directive, _ := event["directive"].(map[string]interface{})
+	header, _ := directive["header"].(map[string]interface{})
+	if messageID, ok := header["messageId"].(string); ok {
+		fields = append(fields, zap.String("messageId", messageID))
+	}
+	return h.Logger.With(fields...)
+}
+
+// logSummary writes a one-line outcome of a request for console output.
+func (h *LambdaHandler) logSummary(ctx context.Context, event map[string]interface{}, elapsed time.Duration, err error) {
+	info, _ := h.parseDirective(ctx, event)
+	name := info.Namespace + "." + info.Name
+	if info.Name == "" {
+		name = "unknown directive"
+	}
+	elapsed = elapsed.Round(100 * time.Microsecond)
+
+	if err != nil {
+		h.logger(ctx).Sugar().Warnf("%s failed in %s: %v", name, elapsed, err)
+		return
+	}
+	h.logger(ctx).Sugar().Infof("%s ok in %s", name, elapsed)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Test that request logs carry the messageId and cold start flag
+func TestHandleRequest_RequestLogger(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example"})
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+	core, logs := observer.New(zap.InfoLevel)
+	handler.Logger = zap.New(core)
+
+	for i := 0; i < 2; i++ {
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+			t.Fatalf("Handler returned an error: %v", err)
+		}
+	}
+
+	events := logs.FilterMessageSnippet("Event:").All()
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 event logs, got %d", len(events))
+	}
+	for i, coldStart := range []bool{true, false} {
+		fields := events[i].ContextMap()
+		if fields["messageId"] != "1bd5d003-31b9-476f-ad03-71d471922820" || fields["coldStart"] != coldStart {
+			t.Errorf("Request %d: unexpected fields %v", i, fields)
+		}
+	}
+}
+
+// Test that DEBUG logs a timing line including the tailnet startup once
+func TestHandleRequest_DebugTiming(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", Debug: true})
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+	handler.tailnetReady = 1500 * time.Millisecond
+	core, logs := observer.New(zap.DebugLevel)
+	handler.Logger = zap.New(core)
+
+	for i := 0; i < 2; i++ {
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+			t.Fatalf("Handler returned an error: %v", err)
+		}
+	}
+
+	timings := logs.FilterMessage("Timing").All()
+	if len(timings) != 2 {
+		t.Fatalf("Expected 2 timing logs, got %d", len(timings))
+	}
+	for i, tailnetMs := range []float64{1500, 0} {
+		fields := timings[i].ContextMap()
+		if fields["tailnetMs"] != tailnetMs || fields["totalMs"] == nil {
+			t.Errorf("Request %d: unexpected fields %v", i, fields)
+		}
+	}
+}
@@ -5,19 +5,30 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 	"tailscale.com/tsnet"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdaurl"
 )
 
+// HTTPDoer is the subset of *http.Client the handler uses to reach Home
+// Assistant, so tests can substitute upstream behaviour.
+type HTTPDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
 type LambdaHandler struct {
 	BaseURL        string
 	Debug          bool
@@ -25,126 +36,480 @@ type LambdaHandler struct {
 	VerifySSL      bool
 	Logger         *zap.Logger
 	TSNetServer    *tsnet.Server
+	// HTTPClient overrides the client built from TSNetServer and VerifySSL
+	HTTPClient HTTPDoer
+
+	// Built from TSNetServer and VerifySSL on first use, see sharedClient
+	client     *http.Client
+	clientOnce sync.Once
+
+	config         Config
+	discoveryCache *discoveryCache
+	inFlight       chan struct{}
+	recorder       recordSink
+	envelope       *envelopeChecker
+	tokenRejected  atomic.Bool
+	tokenCheckedAt atomic.Int64
+	routes         routeTable
+	accounts       accountResolver
+	tenants        *tenantConfigs
+	metricsOut     io.Writer
+	failover       *failover
+	split          *trafficSplit
+	shadow         *shadowTarget
+	backends       []backend
+	quotas         *tenantQuotas
+	tokens         *tokenCache
+	replayGuard    *replayGuard
+	states         *stateCache
+	invocations    atomic.Int64
+	shutdownOnce   sync.Once
+	stats          requestStats
+	loginMu        sync.Mutex
+	entities       *entityFilter
+	// How long startTailnet took, see logTiming
+	tailnetReady time.Duration
+	recentLogs   *logRing
+	// End of the last invocation, see checkResume
+	resumeMu   sync.Mutex
+	lastActive time.Time
+	// Tried before defaultScopeExtractors, see scope.go
+	scopeExtractors []ScopeExtractor
+	// Major payloadVersions already warned about, see compatibleVersion
+	versionMu       sync.Mutex
+	versionWarnings map[int]bool
+	// Added to every upstream request, see upstream_auth.go
+	upstreamHeader http.Header
 }
 
-func NewLambdaHandler(tsNetServer *tsnet.Server) *LambdaHandler {
-	baseURL := strings.TrimRight(os.Getenv("BASE_URL"), "/")
-	if baseURL == "" {
-		panic("Please set BASE_URL environment variable")
+func NewLambdaHandler(cfg Config, tsNetServer *tsnet.Server) (*LambdaHandler, error) {
+	baseURL := strings.TrimRight(cfg.BaseURL, "/")
+	if baseURL == "" && cfg.RoutesFile == "" && cfg.RoutesTable == "" && cfg.BackendsFile == "" {
+		return nil, fmt.Errorf("please set BASE_URL environment variable")
 	}
 
-	debug := os.Getenv("DEBUG") == "true"
-	logger, err := zap.NewProduction()
-	if debug {
-		logger, err = zap.NewDevelopment()
-	}
+	logger, err := newLogger(cfg)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to initialize logger: %v", err))
+		return nil, fmt.Errorf("failed to initialize logger: %w", err)
 	}
 
-	longLivedToken := os.Getenv("LONG_LIVED_ACCESS_TOKEN")
-	verifySSL := os.Getenv("NOT_VERIFY_SSL") != "true"
-
+	recentLogs := newLogRing(recentLogLines)
 	h := &LambdaHandler{
 		BaseURL:        baseURL,
-		Debug:          debug,
-		LongLivedToken: longLivedToken,
-		VerifySSL:      verifySSL,
-		Logger:         logger,
+		Debug:          cfg.Debug,
+		LongLivedToken: cfg.LongLivedToken,
+		VerifySSL:      !cfg.NotVerifySSL,
+		Logger:         logger.WithOptions(zap.WrapCore(recentLogs.tee)),
+		config:         cfg,
+		tokens:         newTokenCache(cfg.TokenCacheDir),
+		recentLogs:     recentLogs,
+	}
+
+	if cfg.ReplayWindow > 0 || cfg.MaxClockSkew > 0 {
+		h.replayGuard = newReplayGuard(cfg.ReplayWindow, cfg.MaxClockSkew)
+	}
+
+	h.scopeExtractors = parseScopePaths(cfg.ScopePaths)
+
+	entities, err := newEntityFilter(cfg.EntityAllow, cfg.EntityDeny)
+	if err != nil {
+		return nil, err
+	}
+	h.entities = entities
+
+	if cfg.EndpointHealthFallback || cfg.WarmStates {
+		h.states = newStateCache()
+	}
+
+	if cfg.DiscoveryCacheTTL > 0 {
+		h.discoveryCache = newDiscoveryCache(cfg.DiscoveryCacheTTL)
+	}
+
+	if cfg.EnvelopeChecks {
+		envelope, err := newEnvelopeChecker()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load envelope checks: %w", err)
+		}
+		h.envelope = envelope
+	}
+
+	routes, err := newRouteTable(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize routing: %w", err)
+	}
+	h.routes = routes
+	if routes != nil || forwardsUserHash(cfg.ForwardHeaders) {
+		h.accounts = newAccountResolver()
+	}
+
+	if cfg.UpstreamAuthSecret != "" {
+		header, err := loadUpstreamAuth(context.Background(), cfg.UpstreamAuthSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream auth: %w", err)
+		}
+		h.upstreamHeader = header
+	}
+
+	store, err := newStateStore(context.Background(), cfg.StateStore, cfg.Stage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize state store: %w", err)
+	}
+	if store != nil {
+		h.tokens.durable = tokenStore{store: store}
+	}
+	if routes != nil {
+		if h.quotas, err = newTenantQuotas(context.Background(), cfg); err != nil {
+			return nil, fmt.Errorf("failed to initialize quotas: %w", err)
+		}
+	}
+
+	tenants, err := tenantConfigsFor(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize tenant settings: %w", err)
+	}
+	h.tenants = tenants
+
+	recorder, err := newRecordSink(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize recording: %w", err)
+	}
+	h.recorder = recorder
+
+	h.failover = newFailover(cfg)
+	h.split = newTrafficSplit(cfg)
+	h.shadow = newShadowTarget(cfg)
+
+	if cfg.BackendsFile != "" {
+		backends, err := loadBackends(cfg.BackendsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load backends: %w", err)
+		}
+		h.backends = backends
+	}
+
+	if cfg.EMFMetrics {
+		h.metricsOut = os.Stdout
 	}
 
 	if tsNetServer != nil {
 		h.TSNetServer = tsNetServer
 	}
-	return h
+	return h, nil
 }
 
 func (h *LambdaHandler) HandleRequest(ctx context.Context, event map[string]interface{}) (map[string]interface{}, error) {
-	h.Logger.Sugar().Infof("Event: %+v", event)
+	h.checkResume(ctx)
+	defer h.markActive()
 
-	// Extract directive
-	directive, ok := event["directive"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("malformatted request - missing directive")
+	if isSelfTest(event) {
+		report := h.runDiagnostics(ctx)
+		if h.metricsOut != nil {
+			h.emitHealth(ctx, h.metricsOut, report)
+		}
+		return report.toMap(), nil
+	}
+	if isRotateAuthKey(event) {
+		rotator, err := h.newAuthKeyRotator(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result, err := rotator.rotate(ctx)
+		if err != nil {
+			h.logger(ctx).Sugar().Errorf("Auth key rotation failed: %v", err)
+			return nil, err
+		}
+		h.logger(ctx).Sugar().Infof("Auth key %s expires %s, rotated: %t", result.KeyID, result.Expires.Format(time.RFC3339), result.Rotated)
+		return map[string]interface{}{"rotated": result.Rotated, "keyId": result.KeyID, "expires": result.Expires}, nil
+	}
+	if dest, ok := isSupportBundle(event); ok {
+		location, err := h.writeSupportBundle(ctx, dest)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"supportBundle": location}, nil
 	}
 
-	header, ok := directive["header"].(map[string]interface{})
-	if !ok || header["payloadVersion"] != "3" {
-		return nil, fmt.Errorf("only support payloadVersion == 3")
+	ctx, scope := withRequestScope(ctx)
+	ctx = withLogger(ctx, h.requestLogger(event))
+	var timing *requestTiming
+	if h.config.Debug {
+		ctx, timing = withTiming(ctx)
+	}
+	start := time.Now()
+	h.stats.inFlight.Add(1)
+	response, err := h.handle(ctx, event)
+	h.stats.inFlight.Add(-1)
+	elapsed := time.Since(start)
+	h.stats.requests.Add(1)
+	if err != nil {
+		h.stats.errors.Add(1)
+	}
+	if h.recorder != nil {
+		h.record(ctx, event, response, err)
+	}
+	if h.metricsOut != nil {
+		h.emitMetrics(ctx, h.metricsOut, scope.tenant, elapsed, err)
+	}
+	if timing != nil {
+		h.logTiming(ctx, timing)
 	}
+	if h.config.LogFormat == "console" {
+		h.logSummary(ctx, event, elapsed, err)
+	}
+	return response, err
+}
+
+func (h *LambdaHandler) handle(ctx context.Context, event map[string]interface{}) (map[string]interface{}, error) {
+	h.logger(ctx).Sugar().Infof("Event: %+v", event)
 
-	// Extract scope
-	scope := h.extractScope(directive)
-	if scope == nil {
-		return nil, fmt.Errorf("malformatted request - missing endpoint.scope")
+	if h.envelope != nil {
+		for _, violation := range h.envelope.checkDirective(event) {
+			h.logger(ctx).Sugar().Warnf("Directive envelope violation: %s", violation)
+		}
 	}
 
-	scopeType, _ := scope["type"].(string)
-	if scopeType != "BearerToken" {
-		return nil, fmt.Errorf("only support BearerToken")
+	info, err := h.parseDirective(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	if h.replayGuard != nil {
+		if err := h.replayGuard.check(info, event, time.Now()); err != nil {
+			h.logger(ctx).Sugar().Warnf("Rejected directive %s: %v", info.MessageID, err)
+			return nil, err
+		}
+	}
+	if scope := scopeFrom(ctx); scope != nil && len(h.config.ForwardHeaders) > 0 {
+		scope.headers = h.provenance(ctx, info)
 	}
 
-	token := h.LongLivedToken
+	// Serve repeated discovery from memory
+	if info.isDiscovery() && h.discoveryCache != nil {
+		if response, ok := h.discoveryCache.get(info.ScopeToken); ok {
+			h.logger(ctx).Sugar().Info("Serving discovery response from cache")
+			return response, nil
+		}
+	}
 
-	client := h.createHTTPClient()
+	target, err := h.upstreamFor(ctx, info)
+	if err == nil {
+		target, err = h.applyTenantConfig(ctx, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scope := scopeFrom(ctx); scope != nil {
+		scope.tenant = target.Tenant
+	}
+	if !target.allows(info.Namespace) {
+		return nil, errNamespaceDisabled
+	}
+	if target.Tenant == "" && h.tokenStillRejected(ctx, time.Now()) {
+		return nil, errTokenRejected
+	}
+	if target.Tenant != "" && h.quotas != nil {
+		if err := h.admit(ctx, target, time.Now()); err != nil {
+			h.logger(ctx).Sugar().Warnf("Rejected directive: %v", err)
+			return nil, err
+		}
+	}
 
-	// Serialize event to JSON
-	eventJSON, err := json.Marshal(event)
+	if h.entities != nil && info.EndpointID != "" && !h.entities.allowed(info.EndpointID) {
+		h.logger(ctx).Sugar().Warnf("Refusing %s.%s for filtered endpoint %q", info.Namespace, info.Name, info.EndpointID)
+		return alexaErrorResponse(event, "NO_SUCH_ENDPOINT", "endpoint is not exposed to Alexa"), nil
+	}
+	if h.config.DryRun != "" && !info.isReadOnly() {
+		return h.dryRun(ctx, info, event), nil
+	}
+	if h.config.WarmStates && info.isReportState() {
+		if response, ok := h.warmReport(ctx, info, event, time.Now()); ok {
+			return response, nil
+		}
+	}
+	if h.config.WarmStates && info.EndpointID != "" && !info.isReadOnly() {
+		// The directive changes the state that was warmed
+		h.states.dropWarm(info)
+	}
+
+	var responseBody map[string]interface{}
+	if h.backends != nil && target.Tenant == "" {
+		responseBody, err = h.aggregate(ctx, info, event)
+	} else {
+		responseBody, err = h.dispatch(ctx, info, target, event)
+		if errors.Is(err, errUpstreamUnavailable) && h.reloginIfNeeded(ctx) {
+			responseBody, err = h.dispatch(ctx, info, target, event)
+		}
+	}
 	if err != nil {
-		h.Logger.Sugar().Errorf("Error serializing event: %v", err)
+		if h.config.EndpointHealthFallback && info.isReportState() && unhealthy(err) {
+			return h.unreachableReport(ctx, info, event, time.Now()), nil
+		}
+		return nil, err
+	}
+	h.logger(ctx).Sugar().Infof("Response: %+v", responseBody)
+	h.checkResponse(ctx, info, responseBody)
+	if h.entities != nil && info.isDiscovery() {
+		h.filterDiscovery(ctx, responseBody)
+	}
+	if h.config.ResponseStrip != nil {
+		h.config.ResponseStrip.apply(responseBody)
+	}
+
+	if h.envelope != nil {
+		for _, violation := range h.envelope.checkResponse(responseBody) {
+			h.logger(ctx).Sugar().Warnf("Response envelope violation: %s", violation)
+		}
+	}
+
+	if info.isReportState() && h.states != nil {
+		h.states.put(info, responseBody, time.Now())
+	}
+	if info.isDiscovery() && h.discoveryCache != nil {
+		h.discoveryCache.put(info.ScopeToken, responseBody)
+	}
+	if info.isDiscovery() && h.config.WarmStates && h.backends == nil {
+		h.warmStates(ctx, info, target, responseBody)
+	}
+
+	return responseBody, nil
+}
+
+// dispatch serializes event and sends it to target.
+func (h *LambdaHandler) dispatch(ctx context.Context, info directiveInfo, target upstream, event map[string]interface{}) (map[string]interface{}, error) {
+	// Serialize event to JSON
+	eventBuf := getJSONBuffer()
+	defer putJSONBuffer(eventBuf)
+	if err := eventBuf.enc.Encode(event); err != nil {
+		h.logger(ctx).Sugar().Errorf("Error serializing event: %v", err)
 		return nil, fmt.Errorf("failed to serialize event")
 	}
 
+	if target.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, target.Timeout)
+		defer cancel()
+	}
+	var shadowResults <-chan shadowResult
+	// Like failover, the shadow only mirrors the BASE_URL instance; a routed
+	// household's directives and credentials stay with its own instance
+	if h.shadow != nil && h.backends == nil && target.Tenant == "" && info.isReadOnly() {
+		shadowResults = h.startShadow(ctx, eventBuf.Bytes())
+	}
+	responseBody, err := h.send(ctx, info, target, eventBuf.Bytes())
+	if shadowResults != nil {
+		h.compareShadow(ctx, info, shadowResults, responseBody, err)
+	}
+	return responseBody, err
+}
+
+// send forwards a directive, using the standby instance for BASE_URL while
+// failover is active, for the traffic split's share or when the primary
+// fails. A failed directive is only sent again if it is read-only or never
+// reached the primary, so a change such as unlocking a door is not applied
+// twice.
+func (h *LambdaHandler) send(ctx context.Context, info directiveInfo, target upstream, body []byte) (map[string]interface{}, error) {
+	if h.failover == nil || target.Tenant != "" {
+		return h.forward(ctx, target, body)
+	}
+	if h.failover.active() {
+		return h.forwardStandby(ctx, h.failover.secondary, body)
+	}
+	if h.split != nil {
+		secondary, err := h.split.pick(ctx)
+		if err != nil {
+			h.logger(ctx).Sugar().Warnf("Error loading the traffic split: %v", err)
+		}
+		if secondary {
+			response, err := h.forwardStandby(ctx, h.failover.secondary, body)
+			if ctx.Err() != nil {
+				// The caller's deadline or cancel says nothing about the
+				// secondary, and leaves no time for the primary
+				return response, err
+			}
+			if h.split.observe(!unhealthy(err)) {
+				h.logger(ctx).Sugar().Errorf("Secondary failing more than %d%% of directives, sending all traffic to the primary", h.split.maxErrors)
+			}
+			if !unhealthy(err) || !retryable(info, err) {
+				return response, err
+			}
+			// Retried on the primary below
+		}
+	}
+
+	response, err := h.forward(ctx, target, body)
+	if err == nil {
+		h.failover.observe(true)
+		return response, nil
+	}
+	if !unhealthy(err) || ctx.Err() != nil {
+		return nil, err
+	}
+	if h.failover.observe(false) {
+		h.logger(ctx).Sugar().Warnf("Primary failed %d times in a row, using the secondary for %s", h.failover.threshold, h.failover.cooldown)
+	}
+	if !retryable(info, err) {
+		return nil, err
+	}
+	return h.forwardStandby(ctx, h.failover.secondary, body)
+}
+
+// forward POSTs a serialized directive to the smart_home endpoint of target
+// and decodes the response.
+func (h *LambdaHandler) forward(ctx context.Context, target upstream, body []byte) (map[string]interface{}, error) {
+	client := h.httpClient()
+
 	// Make HTTP request
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/alexa/smart_home", h.BaseURL), bytes.NewBuffer(eventJSON))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/alexa/smart_home", target.BaseURL), bytes.NewReader(body))
 	if err != nil {
-		h.Logger.Sugar().Errorf("Error creating request: %v", err)
+		h.logger(ctx).Sugar().Errorf("Error creating request: %v", err)
 		return nil, fmt.Errorf("internal server error")
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", target.Token))
 	req.Header.Set("Content-Type", "application/json")
+	if scope := scopeFrom(ctx); scope != nil {
+		for name, values := range scope.headers {
+			req.Header[name] = values
+		}
+	}
+
+	// Bound concurrent upstream requests, the slot is held until the
+	// response body has been read
+	if h.inFlight != nil {
+		select {
+		case h.inFlight <- struct{}{}:
+			defer func() { <-h.inFlight }()
+		case <-ctx.Done():
+			h.logger(ctx).Sugar().Warnf("Gave up waiting for an upstream slot: %v", ctx.Err())
+			return nil, fmt.Errorf("too many requests in flight")
+		}
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		h.Logger.Sugar().Errorf("Error making HTTP request: %v", err)
-		return nil, fmt.Errorf("internal server error")
+		h.logger(ctx).Sugar().Errorf("Error making HTTP request: %v", err)
+		return nil, upstreamUnavailable(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		message := fmt.Sprintf("status code: %d", resp.StatusCode)
-		h.Logger.Sugar().Warnf("Error response: %s", message)
-		return nil, fmt.Errorf(message)
+		err := &statusError{code: resp.StatusCode}
+		h.logger(ctx).Sugar().Warnf("Error response: %s", err)
+		return nil, err
 	}
 
+	respBuf := getJSONBuffer()
+	defer putJSONBuffer(respBuf)
 	var responseBody map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&responseBody)
+	_, err = respBuf.ReadFrom(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(respBuf.Bytes(), &responseBody)
+	}
 	if err != nil {
-		h.Logger.Sugar().Errorf("Error decoding response: %v", err)
+		h.logger(ctx).Sugar().Errorf("Error decoding response: %v", err)
 		return nil, fmt.Errorf("error decoding response")
 	}
-	h.Logger.Sugar().Infof("Response: %+v", responseBody)
-
 	return responseBody, nil
 }
 
-func (h *LambdaHandler) extractScope(directive map[string]interface{}) map[string]interface{} {
-	if endpoint, ok := directive["endpoint"].(map[string]interface{}); ok {
-		if scope, ok := endpoint["scope"].(map[string]interface{}); ok {
-			return scope
-		}
-	}
-	if payload, ok := directive["payload"].(map[string]interface{}); ok {
-		if scope, ok := payload["grantee"].(map[string]interface{}); ok {
-			return scope
-		}
-		if scope, ok := payload["scope"].(map[string]interface{}); ok {
-			return scope
-		}
-	}
-	return nil
-}
-
 func (h *LambdaHandler) errorType(statusCode int) string {
 	if statusCode == 401 || statusCode == 403 {
 		return "INVALID_AUTHORIZATION_CREDENTIAL"
@@ -152,7 +517,27 @@ func (h *LambdaHandler) errorType(statusCode int) string {
 	return "INTERNAL_ERROR"
 }
 
+func (h *LambdaHandler) httpClient() HTTPDoer {
+	if h.HTTPClient != nil {
+		return h.withUpstreamAuth(h.HTTPClient)
+	}
+	return h.withUpstreamAuth(h.sharedClient())
+}
+
+// sharedClient is built once and used for directives, keepalives and
+// everything else sent upstream, so the connections a keepalive warms are the
+// ones the next directive gets.
+func (h *LambdaHandler) sharedClient() *http.Client {
+	h.clientOnce.Do(func() {
+		h.client = h.createHTTPClient()
+	})
+	return h.client
+}
+
 func (h *LambdaHandler) createHTTPClient() *http.Client {
+	if h.config.UpstreamDial != "" {
+		return h.dialOverrideClient()
+	}
 	var client *http.Client
 	if h.TSNetServer != nil {
 		client = h.TSNetServer.HTTPClient()
@@ -174,27 +559,123 @@ func (h *LambdaHandler) createHTTPClient() *http.Client {
 	return client
 }
 
-func main() {
-	var tsNetServer *tsnet.Server = nil
-	if v := os.Getenv("TS_AUTHKEY"); v != "" {
-		dir := os.Getenv("TS_DIR")
-		if dir == "" {
-			dir = "/tmp/data"
-		}
-		tsNetServer = &tsnet.Server{
-			AuthKey:   v,
-			Ephemeral: true,
-			Hostname:  "hass-alexa-lambda",
-			Dir:       dir,
-		}
-		defer tsNetServer.Close()
-
-		ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
-		_, err := tsNetServer.Up(ctx)
+// startTailnet joins the tailnet when an auth key is configured, keeping node
+// state in STATE_STORE when set. timeout bounds opening the store and
+// bringing the node up, each; waiting for the store's lock has its own
+// budget, stateLockWait. It returns nil without an auth key.
+func startTailnet(cfg Config, timeout time.Duration) (*tsnet.Server, error) {
+	if cfg.TSAuthKey == "" {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	store, err := newStateStore(ctx, cfg.StateStore, cfg.Stage)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	tsNetServer := &tsnet.Server{
+		AuthKey:    cfg.TSAuthKey,
+		ControlURL: cfg.TSControlURL,
+		Ephemeral:  true,
+		Hostname:   cfg.TSHostname,
+		Dir:        cfg.TSDir,
+	}
+	if store != nil && !cfg.TSNodePerEnvironment {
+		// Environments starting at once would otherwise each register a node
+		// and overwrite the others' state
+		lockCtx, cancel := context.WithTimeout(context.Background(), stateLockWait)
+		release, err := lockState(lockCtx, store, "tailscale", stateLockTTL)
+		cancel()
 		if err != nil {
-			log.Fatal("Failed to connect to tailnet: %w", err)
+			return nil, err
 		}
+		defer release()
+		tsNetServer.Store = ipnStore{store: store}
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := tsNetServer.Up(ctx); err != nil {
+		tsNetServer.Close()
+		return nil, err
+	}
+	return tsNetServer, nil
+}
+
+func main() {
+	applyRuntimeTuning()
+
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(doctor(os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "setup" {
+		os.Exit(setup(os.Stdin, os.Stdout, os.Getenv))
+	}
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if cfg.TSAuthKey == "" && cfg.TSAuthKeySecret != "" {
+		if cfg.TSAuthKey, err = loadAuthKey(ctx, cfg.TSAuthKeySecret); err != nil {
+			log.Fatalf("Failed to read TS_AUTHKEY_SECRET: %v", err)
+		}
+	}
+	tailnetStart := time.Now()
+	tsNetServer, err := startTailnet(cfg, 5*time.Second)
+	if err != nil {
+		log.Fatalf("Failed to connect to tailnet: %v", err)
+	}
+
+	handler, err := NewLambdaHandler(cfg, tsNetServer)
+	if err != nil {
+		log.Fatalf("Failed to initialize handler: %v", err)
+	}
+	handler.tailnetReady = time.Since(tailnetStart)
+	defer handler.shutdown()
+	if cfg.ValidateToken {
+		validateCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		handler.validateToken(validateCtx)
+		cancel()
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			if err := serve(handler); err != nil {
+				log.Fatalf("Server failed: %v", err)
+			}
+			return
+		case "support-bundle":
+			dest := ""
+			if len(os.Args) > 2 {
+				dest = os.Args[2]
+			}
+			location, err := handler.writeSupportBundle(context.Background(), dest)
+			if err != nil {
+				log.Fatalf("Support bundle failed: %v", err)
+			}
+			fmt.Println("Wrote", location)
+			return
+		case "replay":
+			if len(os.Args) < 3 {
+				log.Fatal("Usage: main replay <dir>")
+			}
+			mismatches, err := replay(handler, os.Args[2], os.Stdout)
+			if err != nil {
+				log.Fatalf("Replay failed: %v", err)
+			}
+			if mismatches > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	if cfg.CameraRelay {
+		lambdaurl.Start(handler.newCameraMux(), lambda.WithEnableSIGTERM(handler.shutdown))
+		return
 	}
-	handler := NewLambdaHandler(tsNetServer)
-	lambda.Start(handler.HandleRequest)
+	lambda.StartWithOptions(handler.HandleRequest, lambda.WithEnableSIGTERM(handler.shutdown))
 }
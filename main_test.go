@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
 	"testing"
+
+	"go.uber.org/zap"
 )
 
 // Mock HTTP server to simulate the backend API
@@ -18,13 +21,20 @@ func mockServer(responseCode int, responseBody map[string]interface{}) *httptest
 	return httptest.NewServer(handler)
 }
 
+// newTestHandler builds a handler from cfg with logging disabled
+func newTestHandler(t testing.TB, cfg Config) *LambdaHandler {
+	t.Helper()
+	handler, err := NewLambdaHandler(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	handler.Logger = zap.NewNop()
+	return handler
+}
+
 // Test for HandleRequest with Alexa Discovery event
 func TestHandleRequest_Discovery(t *testing.T) {
-	// Set up environment variables
-	os.Setenv("BASE_URL", "http://localhost")
-	os.Setenv("DEBUG", "true")
-	os.Setenv("LONG_LIVED_ACCESS_TOKEN", "mock-token")
-	os.Setenv("NOT_VERIFY_SSL", "true")
+	t.Parallel()
 
 	// Mock response from backend API
 	mockResponse := map[string]interface{}{
@@ -64,11 +74,16 @@ func TestHandleRequest_Discovery(t *testing.T) {
 	mockServer := mockServer(http.StatusOK, mockResponse)
 	defer mockServer.Close()
 
-	// Update BASE_URL to point to the mock server
-	os.Setenv("BASE_URL", mockServer.URL)
-
-	// Initialize the handler
-	handler := NewLambdaHandler(nil)
+	// Initialize the handler against the mock server
+	handler, err := NewLambdaHandler(Config{
+		BaseURL:        mockServer.URL,
+		Debug:          true,
+		LongLivedToken: "mock-token",
+		NotVerifySSL:   true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
 
 	// Define the Discovery event
 	event := map[string]interface{}{
@@ -109,3 +124,94 @@ func TestHandleRequest_Discovery(t *testing.T) {
 
 	t.Logf("Response: %s", responseJSON)
 }
+
+// doerFunc adapts a function to the HTTPDoer interface
+type doerFunc func(*http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func stubResponse(statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// Test HandleRequest against stubbed upstream behaviour
+func TestHandleRequest_UpstreamFailures(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		doer     doerFunc
+		expected string
+	}{
+		{
+			name: "timeout",
+			doer: func(*http.Request) (*http.Response, error) {
+				return nil, context.DeadlineExceeded
+			},
+			expected: "internal server error",
+		},
+		{
+			name: "server error",
+			doer: func(*http.Request) (*http.Response, error) {
+				return stubResponse(http.StatusBadGateway, ""), nil
+			},
+			expected: "status code: 502",
+		},
+		{
+			name: "unauthorized",
+			doer: func(*http.Request) (*http.Response, error) {
+				return stubResponse(http.StatusUnauthorized, ""), nil
+			},
+			expected: "status code: 401",
+		},
+		{
+			name: "malformed JSON",
+			doer: func(*http.Request) (*http.Response, error) {
+				return stubResponse(http.StatusOK, "{not json"), nil
+			},
+			expected: "error decoding response",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestHandler(t, Config{BaseURL: "http://hass.example"})
+			handler.HTTPClient = tt.doer
+
+			_, err := handler.HandleRequest(context.Background(), discoveryEvent())
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("Expected error %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+// Test that the upstream request carries the configured token and target
+func TestHandleRequest_UpstreamRequest(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:        "http://hass.example/",
+		LongLivedToken: "mock-token",
+	})
+
+	var got *http.Request
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if got.URL.String() != "http://hass.example/api/alexa/smart_home" {
+		t.Errorf("Unexpected upstream URL %s", got.URL)
+	}
+	if got.Header.Get("Authorization") != "Bearer mock-token" {
+		t.Errorf("Unexpected Authorization header %q", got.Header.Get("Authorization"))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+const metricsNamespace = "HassTailscaleProxy"
+
+// requestScope carries what is learned about a request while it is handled,
+// so logs and metrics written later can be attributed to a tenant.
+type requestScope struct {
+	tenant string
+	// Sent with every upstream request, see provenance.go
+	headers http.Header
+}
+
+type requestScopeKey struct{}
+
+func withRequestScope(ctx context.Context) (context.Context, *requestScope) {
+	scope := &requestScope{}
+	return context.WithValue(ctx, requestScopeKey{}, scope), scope
+}
+
+func scopeFrom(ctx context.Context) *requestScope {
+	scope, _ := ctx.Value(requestScopeKey{}).(*requestScope)
+	return scope
+}
+
+// emitMetrics writes one request's metrics as a CloudWatch embedded metric
+// format line. With routing configured they carry a Tenant dimension,
+// "default" standing for BASE_URL.
+func (h *LambdaHandler) emitMetrics(ctx context.Context, w io.Writer, tenant string, elapsed time.Duration, err error) {
+	dimensions := [][]string{{}}
+	line := map[string]interface{}{}
+	if h.routes != nil {
+		if tenant == "" {
+			tenant = "default"
+		}
+		dimensions = [][]string{{"Tenant"}}
+		line["Tenant"] = tenant
+	}
+
+	errors := 0
+	if err != nil {
+		errors = 1
+	}
+	line["Latency"] = float64(elapsed.Microseconds()) / 1000
+	line["Errors"] = errors
+	line["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  metricsNamespace,
+			"Dimensions": dimensions,
+			"Metrics": []map[string]string{
+				{"Name": "Latency", "Unit": "Milliseconds"},
+				{"Name": "Errors", "Unit": "Count"},
+			},
+		}},
+	}
+
+	if err := json.NewEncoder(w).Encode(line); err != nil {
+		h.logger(ctx).Sugar().Warnf("Error writing metrics: %v", err)
+	}
+}
+
+// emitHealth writes the composite Healthy metric, 1 when every diagnostics
+// check passed, so a single alarm covers the tailnet, Home Assistant, the
+// token and failover.
+func (h *LambdaHandler) emitHealth(ctx context.Context, w io.Writer, report diagnosticsReport) {
+	healthy := 0
+	if report.OK {
+		healthy = 1
+	}
+	line := map[string]interface{}{
+		"Healthy": healthy,
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  metricsNamespace,
+				"Dimensions": [][]string{{}},
+				"Metrics":    []map[string]string{{"Name": "Healthy", "Unit": "None"}},
+			}},
+		},
+	}
+	if err := json.NewEncoder(w).Encode(line); err != nil {
+		h.logger(ctx).Sugar().Warnf("Error writing metrics: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Test that routed requests are tagged with their tenant in metrics and logs
+func TestHandleRequest_TenantDimensions(t *testing.T) {
+	t.Parallel()
+	routes := writeRoutesFile(t, map[string]upstream{
+		"amzn1.account.home": {Tenant: "home", BaseURL: "http://hass.example"},
+	})
+	handler := newTestHandler(t, Config{RoutesFile: routes})
+	handler.accounts = testAccounts{"access-token-from-skill": "amzn1.account.home"}
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusBadGateway, ""), nil
+	})
+	core, logs := observer.New(zap.InfoLevel)
+	handler.Logger = zap.New(core)
+	var metrics bytes.Buffer
+	handler.metricsOut = &metrics
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err == nil {
+		t.Fatal("Expected an error from the upstream")
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(metrics.Bytes(), &line); err != nil {
+		t.Fatalf("Invalid metrics line %q: %v", metrics.String(), err)
+	}
+	if line["Tenant"] != "home" || line["Errors"] != float64(1) {
+		t.Errorf("Expected an error for tenant home, got %v", line)
+	}
+
+	warnings := logs.FilterMessageSnippet("Error response").All()
+	if len(warnings) != 1 || warnings[0].ContextMap()["tenant"] != "home" {
+		t.Errorf("Expected the upstream error to be logged with the tenant, got %v", warnings)
+	}
+}
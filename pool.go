@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// Buffers that grew past this are dropped instead of pooled so one huge
+// discovery response doesn't pin memory for the lifetime of the sandbox.
+const maxPooledBufferSize = 1 << 20
+
+// jsonBuffer pairs a buffer with an encoder writing into it so both are
+// reused across invocations.
+type jsonBuffer struct {
+	bytes.Buffer
+	enc *json.Encoder
+}
+
+var jsonBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := &jsonBuffer{}
+		b.enc = json.NewEncoder(&b.Buffer)
+		return b
+	},
+}
+
+func getJSONBuffer() *jsonBuffer {
+	b := jsonBufferPool.Get().(*jsonBuffer)
+	b.Reset()
+	return b
+}
+
+func putJSONBuffer(b *jsonBuffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	jsonBufferPool.Put(b)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// provenanceHeaders maps the FORWARD_HEADERS names to the header each one is
+// sent to Home Assistant as.
+var provenanceHeaders = map[string]string{
+	"user_hash":         "X-Alexa-User-Hash",
+	"correlation_token": "X-Alexa-Correlation-Token",
+	"message_id":        "X-Alexa-Message-Id",
+	"invocation_id":     "X-Lambda-Request-Id",
+}
+
+// parseForwardHeaders validates a comma separated FORWARD_HEADERS value.
+func parseForwardHeaders(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := provenanceHeaders[name]; !ok {
+			return nil, fmt.Errorf("invalid FORWARD_HEADERS: unknown %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// forwardsUserHash reports whether FORWARD_HEADERS includes user_hash.
+func forwardsUserHash(names []string) bool {
+	return slices.Contains(names, "user_hash")
+}
+
+// provenance collects the allowed request metadata so Home Assistant
+// automations can tell where a directive came from. The user hash is the
+// SHA-256 of the Amazon user id the Alexa token resolves to, so it stays the
+// same across token refreshes; it is left out if the id can't be resolved.
+func (h *LambdaHandler) provenance(ctx context.Context, info directiveInfo) http.Header {
+	header := make(http.Header, len(h.config.ForwardHeaders))
+	for _, name := range h.config.ForwardHeaders {
+		var value string
+		switch name {
+		case "user_hash":
+			accountID, err := h.accounts.accountID(ctx, info.ScopeToken)
+			if err != nil {
+				h.logger(ctx).Sugar().Warnf("Error resolving the Amazon user id: %v", err)
+				continue
+			}
+			value = tokenHash(accountID)
+		case "correlation_token":
+			value = info.CorrelationToken
+		case "message_id":
+			value = info.MessageID
+		case "invocation_id":
+			if lc, ok := lambdacontext.FromContext(ctx); ok {
+				value = lc.AwsRequestID
+			}
+		}
+		if value != "" {
+			header.Set(provenanceHeaders[name], value)
+		}
+	}
+	return header
+}
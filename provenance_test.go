@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// Test that only allowlisted metadata is forwarded as headers
+func TestHandleRequest_ForwardHeaders(t *testing.T) {
+	t.Parallel()
+	names, err := parseForwardHeaders("user_hash, invocation_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", ForwardHeaders: names})
+	handler.accounts = testAccounts{
+		"access-token-from-skill": "amzn1.account.first",
+		"refreshed-token":         "amzn1.account.first",
+	}
+	var got http.Header
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Header
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-id"})
+	if _, err := handler.HandleRequest(ctx, discoveryEvent()); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if got.Get("X-Alexa-User-Hash") != tokenHash("amzn1.account.first") {
+		t.Errorf("Unexpected user hash %q", got.Get("X-Alexa-User-Hash"))
+	}
+	if got.Get("X-Lambda-Request-Id") != "request-id" {
+		t.Errorf("Unexpected request id %q", got.Get("X-Lambda-Request-Id"))
+	}
+	if got.Get("X-Alexa-Message-Id") != "" {
+		t.Error("Expected the message id not to be forwarded")
+	}
+
+	// The hash follows the account, not the token
+	event := discoveryEvent()
+	event["directive"].(map[string]interface{})["payload"].(map[string]interface{})["scope"].(map[string]interface{})["token"] = "refreshed-token"
+	if _, err := handler.HandleRequest(ctx, event); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if got.Get("X-Alexa-User-Hash") != tokenHash("amzn1.account.first") {
+		t.Errorf("Expected the same user hash after a token refresh, got %q", got.Get("X-Alexa-User-Hash"))
+	}
+
+	if _, err := parseForwardHeaders("user_hash,cookie"); err == nil {
+		t.Error("Expected an unknown name to be rejected")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRateLimited = errors.New("request rate limit exceeded for this account")
+
+// tenantQuotas enforces a request rate per tenant so one busy household
+// can't starve the others of the shared function and tailnet path. A limit
+// of zero or less is unlimited. Lambda scales out over many execution
+// environments, so the count is kept in QUOTA_TABLE when set; otherwise each
+// environment counts on its own.
+type tenantQuotas struct {
+	defaultRate int
+	shared      *dynamoQuota
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket allows rate requests per minute with bursts of the same size.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTenantQuotas(ctx context.Context, cfg Config) (*tenantQuotas, error) {
+	q := &tenantQuotas{
+		defaultRate: cfg.TenantRateLimit,
+		buckets:     make(map[string]*tokenBucket),
+	}
+	if cfg.QuotaTable != "" {
+		client, err := newAWSClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		q.shared = &dynamoQuota{client: client, table: cfg.QuotaTable}
+	}
+	return q, nil
+}
+
+func (q *tenantQuotas) rate(target upstream) int {
+	if target.RateLimit != 0 {
+		return target.RateLimit
+	}
+	return q.defaultRate
+}
+
+// acquire admits a request for target in this environment's token bucket or
+// returns errRateLimited.
+func (q *tenantQuotas) acquire(target upstream, now time.Time) error {
+	rate := q.rate(target)
+	if rate <= 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bucket, ok := q.buckets[target.Tenant]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(rate), last: now}
+		q.buckets[target.Tenant] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Minutes() * float64(rate)
+	if bucket.tokens > float64(rate) {
+		bucket.tokens = float64(rate)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return errRateLimited
+	}
+	bucket.tokens--
+	return nil
+}
+
+// admit counts a directive for target against the shared quota, or this
+// environment's when there is none or it can't be reached.
+func (h *LambdaHandler) admit(ctx context.Context, target upstream, now time.Time) error {
+	rate := h.quotas.rate(target)
+	if rate > 0 && h.quotas.shared != nil {
+		allowed, err := h.quotas.shared.take(ctx, target.Tenant, rate, now)
+		if err == nil {
+			if !allowed {
+				return errRateLimited
+			}
+			return nil
+		}
+		h.logger(ctx).Sugar().Warnf("Error counting the shared quota, using this environment's: %v", err)
+	}
+	return h.quotas.acquire(target, now)
+}
+
+// dynamoQuota counts requests per tenant and minute in a DynamoDB table with
+// a string partition key "key". Counters carry their expiry in "expires", for
+// the table's TTL to remove.
+type dynamoQuota struct {
+	client *awsClient
+	table  string
+}
+
+// take increments the tenant's counter for the current minute unless it has
+// reached rate, and reports whether it did.
+func (q *dynamoQuota) take(ctx context.Context, tenant string, rate int, now time.Time) (bool, error) {
+	window := now.Truncate(time.Minute)
+	in := map[string]interface{}{
+		"TableName":                q.table,
+		"Key":                      map[string]dynamoString{"key": {S: "quota/" + tenant + "/" + strconv.FormatInt(window.Unix(), 10)}},
+		"UpdateExpression":         "ADD #count :one SET #expires = :expires",
+		"ConditionExpression":      "attribute_not_exists(#count) OR #count < :limit",
+		"ExpressionAttributeNames": map[string]string{"#count": "count", "#expires": "expires"},
+		"ExpressionAttributeValues": map[string]dynamoNumber{
+			":one":     {N: "1"},
+			":limit":   {N: strconv.Itoa(rate)},
+			":expires": {N: strconv.FormatInt(window.Add(2*time.Minute).Unix(), 10)},
+		},
+	}
+	err := q.client.callJSON(ctx, "dynamodb", "1.0", "DynamoDB_20120810.UpdateItem", in, nil)
+	var awsErr *awsError
+	if errors.As(err, &awsErr) && strings.Contains(awsErr.body, "ConditionalCheckFailedException") {
+		return false, nil
+	}
+	return err == nil, err
+}
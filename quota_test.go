@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTenantQuotas(t *testing.T) {
+	t.Parallel()
+	quotas, err := newTenantQuotas(context.Background(), Config{TenantRateLimit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	home := upstream{Tenant: "home"}
+
+	for i := 0; i < 2; i++ {
+		if err := quotas.acquire(home, now); err != nil {
+			t.Fatalf("Expected request %d to pass, got %v", i, err)
+		}
+	}
+	if err := quotas.acquire(home, now); err != errRateLimited {
+		t.Errorf("Expected errRateLimited after the burst, got %v", err)
+	}
+	// Other tenants are unaffected
+	if err := quotas.acquire(upstream{Tenant: "cabin"}, now); err != nil {
+		t.Errorf("Expected another tenant to pass, got %v", err)
+	}
+	if err := quotas.acquire(home, now.Add(30*time.Second)); err != nil {
+		t.Errorf("Expected a refilled token after 30s, got %v", err)
+	}
+
+	// A per-tenant override refills faster than the default
+	if err := quotas.acquire(upstream{Tenant: "home", RateLimit: 120}, now.Add(31*time.Second)); err != nil {
+		t.Errorf("Expected the override to allow more, got %v", err)
+	}
+}
+
+// Test that the shared quota counts across handlers, as for several
+// execution environments, and falls back to the local one when unavailable
+func TestHandler_SharedQuota(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	failing := false
+	dynamo := fakeAWS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var in struct {
+			Key                       map[string]dynamoString `json:"Key"`
+			ExpressionAttributeValues map[string]dynamoNumber `json:"ExpressionAttributeValues"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		key := in.Key["key"].S
+		if limit, _ := strconv.Atoi(in.ExpressionAttributeValues[":limit"].N); counts[key] >= limit {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException"}`))
+			return
+		}
+		counts[key]++
+		w.Write([]byte(`{}`))
+	}))
+
+	environment := func() *LambdaHandler {
+		handler := newTestHandler(t, Config{BaseURL: "http://hass"})
+		handler.quotas = &tenantQuotas{defaultRate: 2, buckets: make(map[string]*tokenBucket), shared: &dynamoQuota{client: dynamo, table: "quotas"}}
+		return handler
+	}
+	first, second := environment(), environment()
+	home := upstream{Tenant: "home"}
+	now := time.Now()
+
+	if err := first.admit(context.Background(), home, now); err != nil {
+		t.Fatalf("Expected the first request to pass, got %v", err)
+	}
+	if err := second.admit(context.Background(), home, now); err != nil {
+		t.Fatalf("Expected the second request to pass, got %v", err)
+	}
+	if err := first.admit(context.Background(), home, now); err != errRateLimited {
+		t.Errorf("Expected errRateLimited across environments, got %v", err)
+	}
+	if err := second.admit(context.Background(), home, now.Add(time.Minute)); err != nil {
+		t.Errorf("Expected a new minute to pass, got %v", err)
+	}
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if err := first.admit(context.Background(), upstream{Tenant: "cabin"}, now); err != nil {
+		t.Errorf("Expected the local quota while the table fails, got %v", err)
+	}
+}
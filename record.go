@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Fields replaced before a directive is written to a recording.
+var redactedFields = map[string]bool{
+	"token": true,
+	"code":  true,
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// recording is a single captured invocation.
+type recording struct {
+	RecordedAt time.Time              `json:"recordedAt"`
+	Event      map[string]interface{} `json:"event"`
+	Response   map[string]interface{} `json:"response,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// recordSink stores recordings by name.
+type recordSink interface {
+	save(ctx context.Context, name string, data []byte) error
+}
+
+type dirSink struct {
+	dir string
+}
+
+func (s dirSink) save(ctx context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, name), data, 0o600)
+}
+
+type s3Sink struct {
+	client *awsClient
+	bucket string
+	prefix string
+}
+
+func (s s3Sink) save(ctx context.Context, name string, data []byte) error {
+	return s.client.putObject(ctx, s.bucket, path.Join(s.prefix, name), "application/json", data)
+}
+
+// newRecordSink builds the sink selected by RECORD_MODE, or nil when
+// recording is disabled.
+func newRecordSink(ctx context.Context, cfg Config) (recordSink, error) {
+	switch cfg.RecordMode {
+	case "":
+		return nil, nil
+	case "local":
+		return dirSink{dir: cfg.RecordDir}, nil
+	case "s3":
+		if cfg.RecordBucket == "" {
+			return nil, fmt.Errorf("RECORD_BUCKET is required with RECORD_MODE=s3")
+		}
+		client, err := newAWSClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return s3Sink{client: client, bucket: cfg.RecordBucket, prefix: cfg.RecordPrefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown RECORD_MODE %q", cfg.RecordMode)
+	}
+}
+
+// record writes a redacted copy of an invocation. Failures are logged and
+// never affect the response to Alexa.
+func (h *LambdaHandler) record(ctx context.Context, event, response map[string]interface{}, handlerErr error) {
+	rec := recording{
+		RecordedAt: time.Now().UTC(),
+		Event:      redact(event),
+		Response:   response,
+	}
+	if handlerErr != nil {
+		rec.Error = handlerErr.Error()
+	}
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		h.logger(ctx).Sugar().Warnf("Error serializing recording: %v", err)
+		return
+	}
+
+	info, _ := h.parseDirective(ctx, event)
+	name := fmt.Sprintf("%s-%s.json", rec.RecordedAt.Format("20060102T150405.000000000"), info.MessageID)
+	name = unsafeNameChars.ReplaceAllString(name, "_")
+	if err := h.recorder.save(ctx, name, data); err != nil {
+		h.logger(ctx).Sugar().Warnf("Error saving recording: %v", err)
+	}
+}
+
+// redact returns a deep copy of event with credentials replaced.
+func redact(event map[string]interface{}) map[string]interface{} {
+	redacted, _ := redactValue(event).(map[string]interface{})
+	return redacted
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if redactedFields[key] {
+				out[key] = "REDACTED"
+				continue
+			}
+			out[key] = redactValue(value)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = redactValue(value)
+		}
+		return out
+	default:
+		return v
+	}
+}
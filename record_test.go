@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that invocations are recorded redacted and can be replayed
+func TestRecordAndReplay(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	handler := newTestHandler(t, Config{
+		BaseURL:    "http://hass.example",
+		RecordMode: "local",
+		RecordDir:  dir,
+	})
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"event":{"header":{"name":"Discover.Response","messageId":"first"}}}`), nil
+	})
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 recording, got %d", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	if strings.Contains(string(data), "access-token-from-skill") {
+		t.Errorf("Recording contains the scope token: %s", data)
+	}
+
+	// Only the messageId differs, which replay ignores
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"event":{"header":{"name":"Discover.Response","messageId":"second"}}}`), nil
+	})
+	var out bytes.Buffer
+	mismatches, err := replay(handler, dir, &out)
+	if err != nil || mismatches != 0 {
+		t.Errorf("Expected a clean replay, got %d mismatches (%v):\n%s", mismatches, err, out.String())
+	}
+
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusInternalServerError, ""), nil
+	})
+	out.Reset()
+	if mismatches, _ := replay(handler, dir, &out); mismatches != 1 {
+		t.Errorf("Expected 1 mismatch, got %d:\n%s", mismatches, out.String())
+	}
+}
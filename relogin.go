@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// How long to wait for the node to come back up after re-authenticating.
+const reloginTimeout = 10 * time.Second
+
+// reloginIfNeeded re-authenticates the node with TS_AUTHKEY when the
+// backend reports NeedsLogin or NeedsMachineAuth, e.g. after the node key
+// expired or the device was removed, instead of failing every directive
+// until a redeploy. It reports whether the node is running again.
+func (h *LambdaHandler) reloginIfNeeded(ctx context.Context) bool {
+	if h.TSNetServer == nil || h.config.TSAuthKey == "" {
+		return false
+	}
+	h.loginMu.Lock()
+	defer h.loginMu.Unlock()
+
+	lc, err := h.TSNetServer.LocalClient()
+	if err != nil {
+		return false
+	}
+	status, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return false
+	}
+	switch status.BackendState {
+	case ipn.NeedsLogin.String(), ipn.NeedsMachineAuth.String():
+	default:
+		return false
+	}
+	h.logger(ctx).Sugar().Warnf("Tailnet node is in state %s, logging in again", status.BackendState)
+
+	ctx, cancel := context.WithTimeout(ctx, reloginTimeout)
+	defer cancel()
+
+	// Logging out drops the stale node key so the auth key registers a
+	// fresh one
+	if err := lc.Logout(ctx); err != nil {
+		h.logger(ctx).Sugar().Warnf("Error logging out stale node: %v", err)
+	}
+	prefs, err := lc.GetPrefs(ctx)
+	if err != nil {
+		h.logger(ctx).Sugar().Errorf("Error reading tailnet prefs: %v", err)
+		return false
+	}
+	prefs.WantRunning = true
+	if err := lc.Start(ctx, ipn.Options{AuthKey: h.loginAuthKey(ctx), UpdatePrefs: prefs}); err != nil {
+		h.logger(ctx).Sugar().Errorf("Error logging in to the tailnet: %v", err)
+		return false
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.logger(ctx).Sugar().Errorf("Tailnet node did not come back up: %v", ctx.Err())
+			return false
+		case <-ticker.C:
+			status, err := lc.StatusWithoutPeers(ctx)
+			if err == nil && status.BackendState == ipn.Running.String() {
+				h.logger(ctx).Sugar().Info("Tailnet node logged in again")
+				return true
+			}
+		}
+	}
+}
+
+// loginAuthKey returns the auth key to log in with. One from
+// TS_AUTHKEY_SECRET is read again, as it may have been rotated since the
+// cold start; the cold start's key is the fallback.
+func (h *LambdaHandler) loginAuthKey(ctx context.Context) string {
+	if h.config.TSAuthKeySecret == "" {
+		return h.config.TSAuthKey
+	}
+	key, err := loadAuthKey(ctx, h.config.TSAuthKeySecret)
+	if err != nil || key == "" {
+		h.logger(ctx).Sugar().Warnf("Error reading TS_AUTHKEY_SECRET, logging in with the key from the cold start: %v", err)
+		return h.config.TSAuthKey
+	}
+	return key
+}
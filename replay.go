@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// Response fields that legitimately change between runs.
+var volatileFields = map[string]bool{
+	"messageId":    true,
+	"timeOfSample": true,
+}
+
+// replay feeds recordings from dir back through the handler and reports
+// the ones whose response or error no longer matches. It returns the number
+// of mismatches.
+func replay(h *LambdaHandler, dir string, out io.Writer) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(paths)
+
+	mismatches := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return mismatches, err
+		}
+		var rec recording
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return mismatches, fmt.Errorf("%s: %w", path, err)
+		}
+
+		response, err := h.handle(context.Background(), rec.Event)
+		var errMsg string
+		if err != nil {
+			errMsg = err.Error()
+		}
+
+		name := filepath.Base(path)
+		switch {
+		case errMsg != rec.Error:
+			mismatches++
+			fmt.Fprintf(out, "FAIL %s: error %q, recorded %q\n", name, errMsg, rec.Error)
+		case !reflect.DeepEqual(stripVolatile(response), stripVolatile(rec.Response)):
+			mismatches++
+			got, _ := json.Marshal(response)
+			want, _ := json.Marshal(rec.Response)
+			fmt.Fprintf(out, "FAIL %s: response differs\n  got:      %s\n  recorded: %s\n", name, got, want)
+		default:
+			fmt.Fprintf(out, "ok   %s\n", name)
+		}
+	}
+	fmt.Fprintf(out, "%d recordings, %d mismatches\n", len(paths), mismatches)
+	return mismatches, nil
+}
+
+// stripVolatile normalizes a response through JSON and drops fields that
+// change on every run.
+func stripVolatile(response map[string]interface{}) interface{} {
+	data, _ := json.Marshal(response)
+	var v interface{}
+	json.Unmarshal(data, &v)
+	return dropFields(v)
+}
+
+func dropFields(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if volatileFields[key] {
+				delete(v, key)
+				continue
+			}
+			v[key] = dropFields(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = dropFields(value)
+		}
+	}
+	return v
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errReplayedDirective = errors.New("directive with this messageId was already handled")
+	errStaleDirective    = errors.New("directive timestamp outside the accepted window")
+)
+
+// replayGuard rejects directives whose messageId was seen within window, or
+// whose timestamp, when the directive carries one, is further than maxSkew
+// from now. Either check is off when its duration is zero. It is defense in
+// depth; Alexa never resends a messageId.
+type replayGuard struct {
+	window  time.Duration
+	maxSkew time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newReplayGuard(window, maxSkew time.Duration) *replayGuard {
+	return &replayGuard{window: window, maxSkew: maxSkew, seen: make(map[string]time.Time)}
+}
+
+func (g *replayGuard) check(info directiveInfo, event map[string]interface{}, now time.Time) error {
+	if ts, ok := directiveTimestamp(event); ok && g.maxSkew > 0 {
+		if skew := now.Sub(ts); skew > g.maxSkew || skew < -g.maxSkew {
+			return errStaleDirective
+		}
+	}
+	if info.MessageID == "" || g.window == 0 {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.lastPrune) > g.window {
+		for id, seen := range g.seen {
+			if now.Sub(seen) > g.window {
+				delete(g.seen, id)
+			}
+		}
+		g.lastPrune = now
+	}
+	if seen, ok := g.seen[info.MessageID]; ok && now.Sub(seen) <= g.window {
+		return errReplayedDirective
+	}
+	g.seen[info.MessageID] = now
+	return nil
+}
+
+// directiveTimestamp returns the RFC 3339 timestamp in the directive header
+// or payload, if any.
+func directiveTimestamp(event map[string]interface{}) (time.Time, bool) {
+	directive, _ := event["directive"].(map[string]interface{})
+	for _, section := range []string{"header", "payload"} {
+		fields, _ := directive[section].(map[string]interface{})
+		if value, ok := fields["timestamp"].(string); ok {
+			ts, err := time.Parse(time.RFC3339, value)
+			return ts, err == nil
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayGuard(t *testing.T) {
+	t.Parallel()
+	guard := newReplayGuard(time.Minute, time.Minute)
+	now := time.Now()
+	info := directiveInfo{MessageID: "message-id"}
+
+	if err := guard.check(info, discoveryEvent(), now); err != nil {
+		t.Fatalf("Expected the first directive to pass, got %v", err)
+	}
+	if err := guard.check(info, discoveryEvent(), now.Add(time.Second)); err != errReplayedDirective {
+		t.Errorf("Expected errReplayedDirective, got %v", err)
+	}
+	if err := guard.check(info, discoveryEvent(), now.Add(2*time.Minute)); err != nil {
+		t.Errorf("Expected the messageId to be forgotten after the window, got %v", err)
+	}
+
+	event := discoveryEvent()
+	event["directive"].(map[string]interface{})["header"].(map[string]interface{})["timestamp"] = now.Add(-time.Hour).Format(time.RFC3339)
+	if err := guard.check(directiveInfo{MessageID: "other"}, event, now); err != errStaleDirective {
+		t.Errorf("Expected errStaleDirective, got %v", err)
+	}
+	if err := newReplayGuard(time.Minute, 0).check(directiveInfo{MessageID: "other"}, event, now); err != nil {
+		t.Errorf("Expected no timestamp check without MAX_CLOCK_SKEW, got %v", err)
+	}
+}
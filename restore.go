@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// Wall and monotonic clocks drifting apart by this much between two
+	// invocations means the environment was restored from a snapshot.
+	restoreClockSkew = 2 * time.Second
+	// Bound on re-establishing the tailnet before the first directive.
+	restoreTimeout = 3 * time.Second
+)
+
+// closeIdleConnections drops the pooled connections of the client every
+// upstream request goes through.
+func (h *LambdaHandler) closeIdleConnections() {
+	if h.HTTPClient == nil {
+		h.sharedClient().CloseIdleConnections()
+		return
+	}
+	if closer, ok := h.HTTPClient.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// resumed reports whether the gap since the last invocation, measured on the
+// monotonic and the wall clock, says the connections may be stale. A
+// snapshot restore moves the wall clock but not the monotonic one; a long
+// idle gap, e.g. a provisioned environment kept warm for hours, is caught by
+// idleReset when set.
+func resumed(monotonic, wall, idleReset time.Duration) bool {
+	skew := wall - monotonic
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew >= restoreClockSkew || (idleReset > 0 && monotonic >= idleReset)
+}
+
+// markActive records the end of an invocation for checkResume.
+func (h *LambdaHandler) markActive() {
+	h.resumeMu.Lock()
+	defer h.resumeMu.Unlock()
+	h.lastActive = time.Now()
+}
+
+// checkResume re-establishes the tailnet before a directive when the
+// environment was resumed from a snapshot or idle for TAILNET_IDLE_RESET.
+func (h *LambdaHandler) checkResume(ctx context.Context) {
+	h.resumeMu.Lock()
+	last := h.lastActive
+	h.resumeMu.Unlock()
+	if last.IsZero() {
+		return
+	}
+	now := time.Now()
+	monotonic, wall := now.Sub(last), now.Round(0).Sub(last.Round(0))
+	if !resumed(monotonic, wall, h.config.TailnetIdleReset) {
+		return
+	}
+	h.logger(ctx).Sugar().Infof("Resumed after %s (wall clock %s), re-establishing connections", monotonic.Round(time.Millisecond), wall.Round(time.Millisecond))
+	h.reestablish(ctx)
+}
+
+// reestablish drops pooled connections, has the tailnet node rebind its
+// sockets and re-probe its endpoints, and logs in again if the node lost its
+// session while suspended.
+func (h *LambdaHandler) reestablish(ctx context.Context) {
+	h.closeIdleConnections()
+	if h.TSNetServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, restoreTimeout)
+	defer cancel()
+	lc, err := h.TSNetServer.LocalClient()
+	if err != nil {
+		h.logger(ctx).Sugar().Warnf("Error re-establishing the tailnet: %v", err)
+		return
+	}
+	for _, action := range []string{"rebind", "restun"} {
+		if err := lc.DebugAction(ctx, action); err != nil {
+			h.logger(ctx).Sugar().Warnf("Error re-establishing the tailnet (%s): %v", action, err)
+		}
+	}
+	if check := h.checkTailnet(ctx); !check.OK {
+		h.logger(ctx).Sugar().Warnf("Tailnet unhealthy after resume: %s", check.Detail)
+		h.reloginIfNeeded(ctx)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResumed(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		monotonic, wall, idleReset time.Duration
+		expected                   bool
+	}{
+		{time.Second, time.Second, 0, false},
+		// Restored from a snapshot taken an hour ago
+		{time.Second, time.Hour, 0, true},
+		{time.Hour, time.Hour, 0, false},
+		{time.Hour, time.Hour, 30 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		if got := resumed(tt.monotonic, tt.wall, tt.idleReset); got != tt.expected {
+			t.Errorf("resumed(%s, %s, %s) = %t, expected %t", tt.monotonic, tt.wall, tt.idleReset, got, tt.expected)
+		}
+	}
+}
+
+type closingDoer struct {
+	doerFunc
+	closed int
+}
+
+func (d *closingDoer) CloseIdleConnections() { d.closed++ }
+
+// Test that connections are dropped after an idle gap
+func TestHandleRequest_IdleReset(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", TailnetIdleReset: time.Minute})
+	client := &closingDoer{doerFunc: func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	}}
+	handler.HTTPClient = client
+
+	for i := 0; i < 2; i++ {
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+			t.Fatalf("Handler returned an error: %v", err)
+		}
+	}
+	if client.closed != 0 {
+		t.Errorf("Expected no reset between back to back requests, got %d", client.closed)
+	}
+
+	handler.lastActive = time.Now().Add(-time.Hour)
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if client.closed != 1 {
+		t.Errorf("Expected connections reset after an hour idle, got %d", client.closed)
+	}
+}
+
+type closingTransport struct {
+	http.RoundTripper
+	closed atomic.Int32
+}
+
+func (t *closingTransport) CloseIdleConnections() { t.closed.Add(1) }
+
+// Test that a resume drops the connections of the client directives use
+func TestReestablish_SharedClient(t *testing.T) {
+	t.Parallel()
+	upstream := fakeHomeAssistant("mock-token")
+	defer upstream.Close()
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "mock-token"})
+	transport := &closingTransport{RoundTripper: http.DefaultTransport}
+	handler.sharedClient().Transport = transport
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	handler.reestablish(context.Background())
+	if transport.closed.Load() != 1 {
+		t.Errorf("Expected the shared client's connections closed, got %d", transport.closed.Load())
+	}
+}
@@ -0,0 +1,97 @@
+// Package retry labels errors from calls to Home Assistant as worth retrying
+// or not. The proxy decides failover and retries with it, and programs
+// embedding or wrapping the proxy can use it to make the same decisions.
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Class is the kind of failure an error stands for.
+type Class int
+
+const (
+	// None is the class of a nil error.
+	None Class = iota
+	// Network means the upstream could not be reached or the connection
+	// broke, e.g. refused, reset or a DNS failure.
+	Network
+	// Throttled is a 429 or 408 status; retry after a delay.
+	Throttled
+	// ServerError is a 5xx status.
+	ServerError
+	// ClientError is any other 4xx status, such as a rejected token. The
+	// same request fails again.
+	ClientError
+	// Deadline means the caller's deadline passed; there is no time left
+	// for another attempt.
+	Deadline
+	// Canceled means the caller gave up.
+	Canceled
+	// Other is an error none of the above applies to.
+	Other
+)
+
+var classNames = [...]string{"none", "network", "throttled", "server_error", "client_error", "deadline", "canceled", "other"}
+
+func (c Class) String() string {
+	if c < 0 || int(c) >= len(classNames) {
+		return "unknown"
+	}
+	return classNames[c]
+}
+
+// Retryable reports whether another attempt of the same request may succeed.
+func (c Class) Retryable() bool {
+	return c == Network || c == Throttled || c == ServerError
+}
+
+// Classify labels err. It recognizes, in order, context errors, an HTTP
+// status exposed by a StatusCode() int method anywhere in the chain, and
+// network failures: a net.Error or an error with an Unreachable() bool
+// method returning true.
+func Classify(err error) Class {
+	if err == nil {
+		return None
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Deadline
+	}
+	if errors.Is(err, context.Canceled) {
+		return Canceled
+	}
+
+	var status interface{ StatusCode() int }
+	if errors.As(err, &status) {
+		code := status.StatusCode()
+		switch {
+		case code == http.StatusTooManyRequests || code == http.StatusRequestTimeout:
+			return Throttled
+		case code >= 500:
+			return ServerError
+		case code >= 400:
+			return ClientError
+		}
+		return Other
+	}
+
+	var unreachable interface{ Unreachable() bool }
+	if errors.As(err, &unreachable) && unreachable.Unreachable() {
+		return Network
+	}
+	// Includes dial and handshake timeouts, which say nothing about the
+	// caller's deadline
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return Network
+	}
+	return Other
+}
+
+// Retryable reports whether err is worth another attempt.
+func Retryable(err error) bool {
+	return Classify(err).Retryable()
+}
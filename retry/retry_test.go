@@ -0,0 +1,45 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+type statusError int
+
+func (e statusError) Error() string   { return fmt.Sprintf("status code: %d", int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+type unreachableError struct{}
+
+func (unreachableError) Error() string     { return "unreachable" }
+func (unreachableError) Unreachable() bool { return true }
+
+func TestClassify(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err       error
+		expected  Class
+		retryable bool
+	}{
+		{nil, None, false},
+		{statusError(502), ServerError, true},
+		{fmt.Errorf("discovery: %w", statusError(503)), ServerError, true},
+		{statusError(429), Throttled, true},
+		{statusError(401), ClientError, false},
+		{unreachableError{}, Network, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, Network, true},
+		{fmt.Errorf("forward: %w", context.DeadlineExceeded), Deadline, false},
+		{context.Canceled, Canceled, false},
+		{errors.New("invalid JSON"), Other, false},
+	}
+	for _, tt := range tests {
+		class := Classify(tt.err)
+		if class != tt.expected || Retryable(tt.err) != tt.retryable {
+			t.Errorf("Classify(%v) = %s (retryable %t), expected %s (retryable %t)", tt.err, class, class.Retryable(), tt.expected, tt.retryable)
+		}
+	}
+}
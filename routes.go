@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long DynamoDB route lookups are kept in memory.
+	routeCacheTTL = 5 * time.Minute
+	// Login with Amazon access tokens are valid for an hour, so a token's
+	// account needs looking up at most once.
+	accountCacheTTL = time.Hour
+	// Entries each of the caches holds at most.
+	routeCacheEntries = 1024
+)
+
+// amazonProfileURL returns the Amazon account a Login with Amazon access
+// token was issued for.
+const amazonProfileURL = "https://api.amazon.com/user/profile"
+
+var errNoRoute = errors.New("no Home Assistant instance configured for this account")
+
+// upstream is the Home Assistant instance a directive is sent to. Tenant is
+// empty for the instance configured through BASE_URL.
+type upstream struct {
+	Tenant  string `json:"tenant"`
+	BaseURL string `json:"baseUrl"`
+	Token   string `json:"token"`
+
+	// Set from the tenant's SSM namespace, see tenant_config.go
+	Timeout    time.Duration `json:"-"`
+	Namespaces []string      `json:"-"`
+	RateLimit  int           `json:"-"`
+}
+
+// routeTable maps the Amazon user id of an Alexa account to an instance.
+type routeTable interface {
+	lookup(ctx context.Context, accountID string) (upstream, bool, error)
+}
+
+// fileRoutes is a routing table loaded from a JSON object keyed by Amazon
+// user id, see ROUTES_FILE.
+type fileRoutes map[string]upstream
+
+func loadFileRoutes(path string) (fileRoutes, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes fileRoutes
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for accountID, route := range routes {
+		if route.Tenant == "" {
+			return nil, fmt.Errorf("%s: route for %s has no tenant", path, accountID)
+		}
+	}
+	return routes, nil
+}
+
+func (r fileRoutes) lookup(ctx context.Context, accountID string) (upstream, bool, error) {
+	route, ok := r[accountID]
+	return route, ok, nil
+}
+
+// dynamoRoutes reads routes from a DynamoDB table with a string partition
+// key "userId" and string attributes "tenant", "baseUrl" and "token". Only
+// routes found are cached, so a newly added account works right away.
+type dynamoRoutes struct {
+	client *awsClient
+	table  string
+	cache  *ttlCache[upstream]
+}
+
+type dynamoString struct {
+	S string `json:"S"`
+}
+
+func (r *dynamoRoutes) lookup(ctx context.Context, accountID string) (upstream, bool, error) {
+	if route, ok := r.cache.get(accountID); ok {
+		return route, true, nil
+	}
+
+	in := map[string]interface{}{
+		"TableName": r.table,
+		"Key": map[string]dynamoString{
+			"userId": {S: accountID},
+		},
+	}
+	var out struct {
+		Item map[string]dynamoString `json:"Item"`
+	}
+	if err := r.client.callJSON(ctx, "dynamodb", "1.0", "DynamoDB_20120810.GetItem", in, &out); err != nil {
+		return upstream{}, false, err
+	}
+	if out.Item == nil {
+		return upstream{}, false, nil
+	}
+
+	route := upstream{
+		Tenant:  out.Item["tenant"].S,
+		BaseURL: out.Item["baseUrl"].S,
+		Token:   out.Item["token"].S,
+	}
+	r.cache.put(accountID, route)
+	return route, true, nil
+}
+
+// accountResolver maps an Alexa access token to the account it belongs to.
+type accountResolver interface {
+	accountID(ctx context.Context, token string) (string, error)
+}
+
+// amazonAccounts resolves Login with Amazon tokens to the Amazon user id,
+// which unlike the token stays the same across refreshes and re-links. The
+// skill's account linking has to request the profile:user_id scope.
+type amazonAccounts struct {
+	url    string
+	client HTTPDoer
+	// user ids by token hash
+	cache *ttlCache[string]
+}
+
+func (a *amazonAccounts) accountID(ctx context.Context, token string) (string, error) {
+	key := tokenHash(token)
+	if id, ok := a.cache.get(key); ok {
+		return id, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		// Not a token Amazon issued, or one that was revoked
+		return "", errNoRoute
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("amazon profile: status code %d", resp.StatusCode)
+	}
+	var profile struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return "", fmt.Errorf("amazon profile: %w", err)
+	}
+	if profile.UserID == "" {
+		return "", fmt.Errorf("amazon profile: no user_id, is the profile:user_id scope requested when linking?")
+	}
+	a.cache.put(key, profile.UserID)
+	return profile.UserID, nil
+}
+
+// ttlCache is a map whose entries expire, holding at most max of them.
+type ttlCache[V any] struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]ttlEntry[V]
+}
+
+type ttlEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTTLCache[V any](ttl time.Duration, max int) *ttlCache[V] {
+	return &ttlCache[V]{ttl: ttl, max: max, entries: make(map[string]ttlEntry[V])}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	return entry.value, ok
+}
+
+// put adds an entry, making room by dropping expired entries and then
+// arbitrary ones.
+func (c *ttlCache[V]) put(key string, value V) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = ttlEntry[V]{value: value, expires: now.Add(c.ttl)}
+}
+
+// newRouteTable builds the routing table selected by ROUTES_FILE or
+// ROUTES_TABLE, or nil when every directive goes to BASE_URL.
+func newRouteTable(ctx context.Context, cfg Config) (routeTable, error) {
+	switch {
+	case cfg.RoutesFile != "":
+		return loadFileRoutes(cfg.RoutesFile)
+	case cfg.RoutesTable != "":
+		client, err := newAWSClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &dynamoRoutes{client: client, table: cfg.RoutesTable, cache: newTTLCache[upstream](routeCacheTTL, routeCacheEntries)}, nil
+	}
+	return nil, nil
+}
+
+// newAccountResolver returns the resolver for the accounts the routing
+// table is keyed by.
+func newAccountResolver() accountResolver {
+	return &amazonAccounts{
+		url:    amazonProfileURL,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  newTTLCache[string](accountCacheTTL, routeCacheEntries),
+	}
+}
+
+// upstreamFor picks the instance for a directive. With a routing table every
+// account needs a route; BASE_URL only serves setups without one.
+func (h *LambdaHandler) upstreamFor(ctx context.Context, info directiveInfo) (upstream, error) {
+	if h.routes != nil {
+		accountID, err := h.accounts.accountID(ctx, info.ScopeToken)
+		if errors.Is(err, errNoRoute) {
+			return upstream{}, err
+		}
+		var route upstream
+		ok := false
+		if err == nil {
+			route, ok, err = h.routes.lookup(ctx, accountID)
+		}
+		if err != nil {
+			h.logger(ctx).Sugar().Errorf("Error looking up route: %v", err)
+			return upstream{}, fmt.Errorf("internal server error")
+		}
+		if !ok {
+			return upstream{}, errNoRoute
+		}
+		if route.Tenant == "" {
+			// An empty tenant is the BASE_URL instance, which a routed
+			// account must never be treated as
+			h.logger(ctx).Sugar().Errorf("Route for %s has no tenant", accountID)
+			return upstream{}, fmt.Errorf("internal server error")
+		}
+		route.BaseURL = strings.TrimRight(route.BaseURL, "/")
+		return route, nil
+	}
+
+	token, err := h.accessToken(ctx)
+	if err != nil {
+		return upstream{}, err
+	}
+	return upstream{BaseURL: h.BaseURL, Token: token}, nil
+}
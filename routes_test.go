@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that each Alexa token reaches its own Home Assistant instance
+func TestHandleRequest_Routes(t *testing.T) {
+	t.Parallel()
+	instance := func(token string) (*httptest.Server, *int) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Authorization"); got != "Bearer "+token {
+				t.Errorf("Expected token %q, got %q", token, got)
+			}
+			calls++
+			json.NewEncoder(w).Encode(map[string]interface{}{"event": map[string]interface{}{}})
+		}))
+		return server, &calls
+	}
+	first, firstCalls := instance("first-ha-token")
+	defer first.Close()
+	second, secondCalls := instance("second-ha-token")
+	defer second.Close()
+
+	// Stands in for Login with Amazon, where each account's token rotates
+	profileCalls := 0
+	profile := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		profileCalls++
+		accounts := map[string]string{
+			"Bearer first-token":    "amzn1.account.first",
+			"Bearer second-token":   "amzn1.account.second",
+			"Bearer second-token-2": "amzn1.account.second",
+			"Bearer unknown-token":  "amzn1.account.unknown",
+		}
+		id, ok := accounts[r.Header.Get("Authorization")]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"user_id": id})
+	}))
+	defer profile.Close()
+
+	routes := map[string]upstream{
+		"amzn1.account.first":  {Tenant: "first", BaseURL: first.URL + "/", Token: "first-ha-token"},
+		"amzn1.account.second": {Tenant: "second", BaseURL: second.URL, Token: "second-ha-token"},
+	}
+	// BASE_URL is not a fallback for accounts without a route
+	handler := newTestHandler(t, Config{RoutesFile: writeRoutesFile(t, routes), BaseURL: first.URL, LongLivedToken: "first-ha-token"})
+	handler.accounts = &amazonAccounts{url: profile.URL, client: profile.Client(), cache: newTTLCache[string](accountCacheTTL, 2)}
+
+	send := func(token string) error {
+		event := discoveryEvent()
+		scope := event["directive"].(map[string]interface{})["payload"].(map[string]interface{})["scope"].(map[string]interface{})
+		scope["token"] = token
+		_, err := handler.HandleRequest(context.Background(), event)
+		return err
+	}
+	for _, token := range []string{"first-token", "second-token", "second-token-2", "second-token-2"} {
+		if err := send(token); err != nil {
+			t.Fatalf("Handler returned an error for %s: %v", token, err)
+		}
+	}
+	if *firstCalls != 1 || *secondCalls != 3 {
+		t.Errorf("Expected 1 and 3 calls, got %d and %d", *firstCalls, *secondCalls)
+	}
+	if profileCalls != 3 {
+		t.Errorf("Expected each token's account looked up once, got %d lookups", profileCalls)
+	}
+
+	for _, token := range []string{"unknown-token", "forged-token"} {
+		if err := send(token); err != errNoRoute {
+			t.Errorf("%s: expected errNoRoute, got %v", token, err)
+		}
+	}
+}
+
+func TestTTLCache_Bounded(t *testing.T) {
+	t.Parallel()
+	cache := newTTLCache[int](time.Minute, 2)
+	for i, key := range []string{"a", "b", "c"} {
+		cache.put(key, i)
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(cache.entries))
+	}
+	if v, ok := cache.get("c"); !ok || v != 2 {
+		t.Errorf("Expected the newest entry kept, got %d, %v", v, ok)
+	}
+}
+
+// testAccounts resolves Alexa tokens to accounts without Login with Amazon.
+type testAccounts map[string]string
+
+func (a testAccounts) accountID(ctx context.Context, token string) (string, error) {
+	id, ok := a[token]
+	if !ok {
+		return "", errNoRoute
+	}
+	return id, nil
+}
+
+func writeRoutesFile(t *testing.T, v interface{}) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(p, mustJSON(v), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Test that a route without a tenant is never treated as the BASE_URL instance
+func TestRoutes_EmptyTenant(t *testing.T) {
+	t.Parallel()
+	routes := map[string]upstream{"amzn1.account.first": {BaseURL: "http://first", Token: "first-ha-token"}}
+	if _, err := loadFileRoutes(writeRoutesFile(t, routes)); err == nil {
+		t.Error("Expected a route file entry without a tenant to be rejected")
+	}
+
+	dynamo := fakeAWS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Item": {"userId": {"S": "amzn1.account.first"}, "baseUrl": {"S": "http://first"}, "token": {"S": "first-ha-token"}}}`))
+	}))
+	handler := newTestHandler(t, Config{BaseURL: "http://hass", LongLivedToken: "mock-token"})
+	handler.routes = &dynamoRoutes{client: dynamo, table: "routes", cache: newTTLCache[upstream](routeCacheTTL, routeCacheEntries)}
+	handler.accounts = testAccounts{"first-token": "amzn1.account.first"}
+	if _, err := handler.upstreamFor(context.Background(), directiveInfo{ScopeToken: "first-token"}); err == nil {
+		t.Error("Expected a DynamoDB route without a tenant to be rejected")
+	}
+}
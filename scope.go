@@ -0,0 +1,74 @@
+package main
+
+import "strings"
+
+// ScopeExtractor finds the scope object ({"type": "BearerToken", "token":
+// ...}) in a directive, returning nil when the directive has none where the
+// extractor looks.
+type ScopeExtractor interface {
+	ExtractScope(directive map[string]interface{}) map[string]interface{}
+}
+
+// ScopeExtractorFunc adapts a function to ScopeExtractor.
+type ScopeExtractorFunc func(directive map[string]interface{}) map[string]interface{}
+
+func (f ScopeExtractorFunc) ExtractScope(directive map[string]interface{}) map[string]interface{} {
+	return f(directive)
+}
+
+// scopePath extracts the object at a path of keys in the directive.
+type scopePath []string
+
+func (p scopePath) ExtractScope(directive map[string]interface{}) map[string]interface{} {
+	object := directive
+	for _, key := range p {
+		next, ok := object[key].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		object = next
+	}
+	return object
+}
+
+// parseScopePaths reads SCOPE_PATHS, dotted paths within the directive
+// separated by commas, e.g. "payload.auth,endpoint.cookie.scope".
+func parseScopePaths(spec string) []ScopeExtractor {
+	var extractors []ScopeExtractor
+	for _, path := range strings.Split(spec, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			extractors = append(extractors, scopePath(strings.Split(path, ".")))
+		}
+	}
+	return extractors
+}
+
+// The places Alexa puts the scope, in the order they are tried. AcceptGrant
+// carries it in payload.grantee; payload.grant holds the authorization code,
+// not a token, and is never used as the scope.
+var defaultScopeExtractors = []ScopeExtractor{
+	scopePath{"endpoint", "scope"},
+	scopePath{"payload", "grantee"},
+	scopePath{"payload", "scope"},
+}
+
+// RegisterScopeExtractor adds an extractor for a directive shape the
+// defaults don't know. Registered extractors are tried in order before the
+// defaults.
+func (h *LambdaHandler) RegisterScopeExtractor(e ScopeExtractor) {
+	h.scopeExtractors = append(h.scopeExtractors, e)
+}
+
+func (h *LambdaHandler) extractScope(directive map[string]interface{}) map[string]interface{} {
+	for _, e := range h.scopeExtractors {
+		if scope := e.ExtractScope(directive); scope != nil {
+			return scope
+		}
+	}
+	for _, e := range defaultScopeExtractors {
+		if scope := e.ExtractScope(directive); scope != nil {
+			return scope
+		}
+	}
+	return nil
+}
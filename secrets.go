@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// secret is a value kept in Secrets Manager or SSM, named as
+// secretsmanager:<secret-id> or ssm:<parameter-name>.
+type secret interface {
+	load(ctx context.Context) (string, error)
+	store(ctx context.Context, value string) error
+}
+
+// openSecret opens the secret named by spec, read from the variable env.
+func openSecret(ctx context.Context, env, spec string) (secret, error) {
+	kind, location, _ := strings.Cut(spec, ":")
+	if location == "" || (kind != "secretsmanager" && kind != "ssm") {
+		return nil, fmt.Errorf("invalid %s %q, expected secretsmanager:<secret-id> or ssm:<parameter-name>", env, spec)
+	}
+	client, err := newAWSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "ssm" {
+		return &ssmSecret{client: client, name: location}, nil
+	}
+	return &secretsManagerSecret{client: client, id: location}, nil
+}
+
+type secretsManagerSecret struct {
+	client *awsClient
+	id     string
+}
+
+func (s *secretsManagerSecret) load(ctx context.Context) (string, error) {
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	in := map[string]interface{}{"SecretId": s.id}
+	if err := s.client.callJSON(ctx, "secretsmanager", "1.1", "secretsmanager.GetSecretValue", in, &out); err != nil {
+		return "", err
+	}
+	return out.SecretString, nil
+}
+
+func (s *secretsManagerSecret) store(ctx context.Context, value string) error {
+	in := map[string]interface{}{"SecretId": s.id, "SecretString": value}
+	return s.client.callJSON(ctx, "secretsmanager", "1.1", "secretsmanager.PutSecretValue", in, nil)
+}
+
+type ssmSecret struct {
+	client *awsClient
+	name   string
+}
+
+func (s *ssmSecret) load(ctx context.Context) (string, error) {
+	var out struct {
+		Parameter ssmParameter `json:"Parameter"`
+	}
+	in := map[string]interface{}{"Name": s.name, "WithDecryption": true}
+	if err := s.client.callJSON(ctx, "ssm", "1.1", "AmazonSSM.GetParameter", in, &out); err != nil {
+		return "", err
+	}
+	return out.Parameter.Value, nil
+}
+
+func (s *ssmSecret) store(ctx context.Context, value string) error {
+	in := map[string]interface{}{"Name": s.name, "Value": value, "Type": "SecureString", "Overwrite": true}
+	return s.client.callJSON(ctx, "ssm", "1.1", "AmazonSSM.PutParameter", in, nil)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// serve runs the handler behind a plain HTTP listener instead of the Lambda
+// runtime. Directives are POSTed as JSON to / and the response is written back.
+// SIGTERM or SIGINT stops the keepalive along with the listener.
+func serve(h *LambdaHandler) error {
+	cfg := h.config
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if cfg.KeepaliveInterval > 0 {
+		go h.keepalive(ctx, cfg.KeepaliveInterval)
+	}
+	h.limitInFlight(cfg.MaxInFlight)
+	if cfg.WebhookFunnel && h.TSNetServer != nil {
+		go func() {
+			if err := h.serveFunnel(); err != nil {
+				h.Logger.Sugar().Errorf("Funnel listener failed: %v", err)
+			}
+		}()
+	}
+	if cfg.AdminAddr != "" && h.TSNetServer != nil {
+		go func() {
+			if err := h.serveAdmin(cfg.AdminAddr); err != nil {
+				h.Logger.Sugar().Errorf("Admin listener failed: %v", err)
+			}
+		}()
+	}
+
+	mux := h.newServeMux(cfg.DebugToken)
+	h.Logger.Sugar().Infof("Listening on %s", cfg.ServerAddr)
+	return listenUntilSignal(ctx, &http.Server{Addr: cfg.ServerAddr, Handler: mux})
+}
+
+// limitInFlight caps the number of concurrent upstream requests, a limit of
+// zero or less removes the cap.
+func (h *LambdaHandler) limitInFlight(limit int) {
+	if limit <= 0 {
+		h.inFlight = nil
+		return
+	}
+	h.inFlight = make(chan struct{}, limit)
+}
+
+func (h *LambdaHandler) newServeMux(debugToken string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.serveDirective)
+	mux.HandleFunc("/api/webhook/", h.serveWebhook)
+	h.mountUI(mux)
+	if h.config.CameraToken != "" {
+		mux.HandleFunc("/camera/", h.serveCamera)
+	}
+
+	// pprof is only mounted when a token is configured
+	if debugToken != "" {
+		mountPprof(mux, func(next http.Handler) http.Handler {
+			return requireToken(debugToken, next)
+		})
+	}
+	return mux
+}
+
+func (h *LambdaHandler) serveDirective(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var event map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	response, err := h.HandleRequest(r.Context(), event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that pprof endpoints are only reachable with the debug token
+func TestServeMux_PprofRequiresToken(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://localhost"})
+
+	mux := handler.newServeMux("secret")
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without token, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %d with token, got %d", http.StatusOK, rec.Code)
+	}
+
+	// Without a token pprof is not mounted at all
+	mux = handler.newServeMux("")
+	req = httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d when pprof is disabled, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+// Test that directives POSTed to the server are forwarded upstream
+func TestServeMux_Directive(t *testing.T) {
+	t.Parallel()
+	upstream := mockServer(http.StatusOK, map[string]interface{}{"event": map[string]interface{}{}})
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL})
+	mux := handler.newServeMux("")
+
+	body, _ := json.Marshal(discoveryEvent())
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if _, ok := response["event"]; !ok {
+		t.Errorf("Expected event in response, got %v", response)
+	}
+}
+
+// Test that MAX_IN_FLIGHT bounds concurrent upstream requests
+func TestLimitInFlight(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	current, peak := 0, 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current++
+		if current > peak {
+			peak = current
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		current--
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"event": map[string]interface{}{}})
+	}))
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL})
+	handler.limitInFlight(2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+				t.Errorf("Handler returned an error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Errorf("Expected at most 2 concurrent upstream requests, got %d", peak)
+	}
+}
+
+// Test the directive console page and its send endpoint
+func TestServeMux_UI(t *testing.T) {
+	t.Parallel()
+	upstream := mockServer(http.StatusOK, map[string]interface{}{"event": map[string]interface{}{}})
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL})
+	mux := handler.newServeMux("")
+
+	req := httptest.NewRequest(http.MethodGet, "/ui/", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte("Directive console")) {
+		t.Fatalf("Expected console page, got %d", rec.Code)
+	}
+
+	body, _ := json.Marshal(discoveryEvent())
+	req = httptest.NewRequest(http.MethodPost, "/ui/send", bytes.NewReader(body))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var result uiResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	if result.Error != "" || result.Response == nil {
+		t.Errorf("Expected a response, got error %q", result.Error)
+	}
+	if result.Timing.TotalMs <= 0 {
+		t.Errorf("Expected total timing, got %+v", result.Timing)
+	}
+}
+
+func TestListenUntilSignal_Cancel(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- listenUntilSignal(ctx, &http.Server{Addr: "127.0.0.1:0"}) }()
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Expected a clean stop, got %v", err)
+		}
+	case <-time.After(drainTimeout):
+		t.Fatal("Expected the listener to stop with its context")
+	}
+}
+
+func TestShutdown_Idempotent(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example"})
+	handler.shutdown()
+	handler.shutdown()
+}
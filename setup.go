@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// setup walks through the settings needed for a first deployment, checking
+// each as it is entered: BASE_URL, joining the tailnet with TS_AUTHKEY, the
+// long-lived token and a trial discovery. It ends by printing the
+// environment variables for the function. It returns the process exit code.
+func setup(in io.Reader, out io.Writer, getenv func(string) string) int {
+	lines := bufio.NewScanner(in)
+	values := map[string]string{}
+	lookup := func(name string) string {
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return getenv(name)
+	}
+	// ask prompts for name and keeps the current value on an empty answer.
+	// It returns false at the end of the input.
+	ask := func(name, prompt string) bool {
+		current := lookup(name)
+		if current != "" {
+			prompt += fmt.Sprintf(" [%s]", maskSetting(name, current))
+		}
+		fmt.Fprintf(out, "%s: ", prompt)
+		if !lines.Scan() {
+			fmt.Fprintln(out)
+			return false
+		}
+		if answer := strings.TrimSpace(lines.Text()); answer != "" {
+			values[name] = answer
+		} else {
+			values[name] = current
+		}
+		return true
+	}
+
+	fmt.Fprintln(out, "Home Assistant URL as seen from the tailnet, e.g. https://homeassistant.tailnet-name.ts.net:8123")
+	for {
+		if !ask("BASE_URL", "BASE_URL") {
+			return 1
+		}
+		u, err := url.Parse(values["BASE_URL"])
+		if err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			break
+		}
+		fmt.Fprintln(out, "  expected an http:// or https:// URL")
+	}
+
+	fmt.Fprintln(out, "\nTailscale auth key from https://login.tailscale.com/admin/settings/keys, reusable and")
+	fmt.Fprintln(out, "ephemeral. Leave empty if Home Assistant is reachable without the tailnet.")
+	var tsNetServer *tsnet.Server
+	for {
+		if !ask("TS_AUTHKEY", "TS_AUTHKEY") {
+			return 1
+		}
+		if values["TS_AUTHKEY"] == "" {
+			break
+		}
+		cfg, err := configFromLookup(lookup)
+		if err != nil {
+			fmt.Fprintf(out, "  %v\n", err)
+			return 1
+		}
+		fmt.Fprintln(out, "  joining the tailnet...")
+		tsNetServer, err = startTailnet(cfg, 30*time.Second)
+		if err == nil {
+			defer tsNetServer.Close()
+			fmt.Fprintf(out, "  joined as %s\n", cfg.TSHostname)
+			break
+		}
+		fmt.Fprintf(out, "  %v\n  check that the key is valid, not expired and, if single-use, not consumed\n", err)
+	}
+
+	fmt.Fprintf(out, "\nLong-lived access token, create one at %s/profile/security\n", strings.TrimRight(values["BASE_URL"], "/"))
+	fmt.Fprintln(out, "under \"Long-lived access tokens\" for a user that can see the exposed entities.")
+	var h *LambdaHandler
+	for {
+		if !ask("LONG_LIVED_ACCESS_TOKEN", "LONG_LIVED_ACCESS_TOKEN") {
+			return 1
+		}
+		cfg, err := configFromLookup(lookup)
+		if err == nil {
+			h, err = NewLambdaHandler(cfg, tsNetServer)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "  %v\n", err)
+			return 1
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		checks := []checkResult{h.checkReachable(ctx)}
+		if checks[0].OK {
+			checks = append(checks, h.checkToken(ctx))
+		}
+		cancel()
+		printChecks(out, checks)
+		if checks[len(checks)-1].OK {
+			break
+		}
+		if !checks[0].OK {
+			return 1
+		}
+	}
+
+	fmt.Fprintln(out, "\nTrying a discovery...")
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	discovery := h.checkSmartHome(ctx)
+	cancel()
+	printChecks(out, []checkResult{discovery})
+	if !discovery.OK {
+		return 1
+	}
+
+	variables := map[string]string{}
+	fmt.Fprintln(out, "\nEnvironment variables for the function:")
+	for _, name := range []string{"BASE_URL", "LONG_LIVED_ACCESS_TOKEN", "TS_AUTHKEY"} {
+		if values[name] != "" {
+			variables[name] = values[name]
+			fmt.Fprintf(out, "%s=%s\n", name, values[name])
+		}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"Variables": variables})
+	fmt.Fprintln(out, "\nor, for aws lambda update-function-configuration --environment file://env.json:")
+	fmt.Fprintln(out, string(data))
+	return 0
+}
+
+// maskSetting shortens secrets shown as the current value of a prompt.
+func maskSetting(name, value string) string {
+	switch {
+	case name == "BASE_URL":
+		return value
+	case len(value) <= 12:
+		return "..."
+	}
+	return value[:4] + "..." + value[len(value)-4:]
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that setup re-prompts for a rejected token and prints the variables
+func TestSetup(t *testing.T) {
+	t.Parallel()
+	hass := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/api/alexa/smart_home" {
+			w.Write([]byte(`{"event":{"payload":{"endpoints":[{"endpointId":"light#kitchen"}]}}}`))
+			return
+		}
+		w.Write([]byte(`{"message":"API running."}`))
+	}))
+	defer hass.Close()
+
+	in := strings.NewReader("not a url\n" + hass.URL + "\n\nbad-token\ngood-token\n")
+	var out bytes.Buffer
+	if code := setup(in, &out, func(string) string { return "" }); code != 0 {
+		t.Fatalf("Expected success, got %d:\n%s", code, out.String())
+	}
+
+	for _, expected := range []string{
+		"expected an http:// or https:// URL",
+		"[FAIL] token_valid",
+		"discovery returned 1 endpoints",
+		"LONG_LIVED_ACCESS_TOKEN=good-token\n",
+		`{"Variables":{"BASE_URL":"` + hass.URL + `","LONG_LIVED_ACCESS_TOKEN":"good-token"}}`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in output:\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "TS_AUTHKEY=") {
+		t.Error("Expected no TS_AUTHKEY without a key")
+	}
+}
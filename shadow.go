@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Differences logged per shadowed directive.
+const maxShadowDiffs = 10
+
+// shadowTarget mirrors read-only directives to a second instance, for example
+// new hardware or an upgraded Home Assistant, and compares its answers with
+// the primary's. The shadow never affects the response sent to Alexa.
+type shadowTarget struct {
+	upstream upstream
+	timeout  time.Duration
+}
+
+func newShadowTarget(cfg Config) *shadowTarget {
+	if cfg.ShadowBaseURL == "" {
+		return nil
+	}
+	return &shadowTarget{
+		upstream: upstream{Tenant: "shadow", BaseURL: strings.TrimRight(cfg.ShadowBaseURL, "/"), Token: cfg.ShadowToken},
+		timeout:  cfg.ShadowTimeout,
+	}
+}
+
+// isReadOnly reports whether a directive can be sent twice without side
+// effects.
+func (d directiveInfo) isReadOnly() bool {
+	return d.isDiscovery() || d.isReportState()
+}
+
+type shadowResult struct {
+	response map[string]interface{}
+	err      error
+}
+
+// startShadow sends body to the shadow instance in the background. The
+// returned channel yields its result.
+func (h *LambdaHandler) startShadow(ctx context.Context, body []byte) <-chan shadowResult {
+	// The event buffer goes back to the pool when handle returns
+	body = append([]byte(nil), body...)
+	results := make(chan shadowResult, 1)
+	// A fresh context keeps the shadow's connection out of the DEBUG timing
+	// of the primary
+	ctx = withLogger(context.WithValue(context.Background(), requestScopeKey{}, scopeFrom(ctx)), loggerFromContext(ctx))
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, h.shadow.timeout)
+		defer cancel()
+		response, err := h.forwardStandby(ctx, h.shadow.upstream, body)
+		results <- shadowResult{response: response, err: err}
+	}()
+	return results
+}
+
+// compareShadow waits for the shadow result and logs how it differs from the
+// primary's.
+func (h *LambdaHandler) compareShadow(ctx context.Context, info directiveInfo, results <-chan shadowResult, response map[string]interface{}, err error) {
+	shadow := <-results
+	name := info.Namespace + "." + info.Name
+
+	switch {
+	case err != nil && shadow.err != nil:
+		return
+	case err != nil:
+		h.logger(ctx).Sugar().Warnf("Shadow mismatch for %s: primary failed (%v), shadow succeeded", name, err)
+	case shadow.err != nil:
+		h.logger(ctx).Sugar().Warnf("Shadow mismatch for %s: shadow failed (%v), primary succeeded", name, shadow.err)
+	default:
+		diffs := diffJSON("", stripVolatile(response), stripVolatile(shadow.response), nil)
+		if len(diffs) == 0 {
+			h.logger(ctx).Sugar().Debugf("Shadow matched for %s", name)
+			return
+		}
+		h.logger(ctx).Sugar().Warnf("Shadow mismatch for %s: %s", name, strings.Join(diffs, "; "))
+	}
+}
+
+// diffJSON appends the paths at which two decoded JSON values differ, up to
+// maxShadowDiffs.
+func diffJSON(path string, primary, shadow interface{}, diffs []string) []string {
+	if len(diffs) >= maxShadowDiffs {
+		return diffs
+	}
+	switch p := primary.(type) {
+	case map[string]interface{}:
+		s, ok := shadow.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(p)+len(s))
+		for key := range p {
+			keys = append(keys, key)
+		}
+		for key := range s {
+			if _, ok := p[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffs = diffJSON(path+"."+key, p[key], s[key], diffs)
+		}
+		return diffs
+	case []interface{}:
+		s, ok := shadow.([]interface{})
+		if !ok || len(s) != len(p) {
+			break
+		}
+		for i := range p {
+			diffs = diffJSON(fmt.Sprintf("%s[%d]", path, i), p[i], s[i], diffs)
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(primary, shadow) {
+		return diffs
+	}
+	if path == "" {
+		path = "."
+	}
+	return append(diffs, fmt.Sprintf("%s: %s vs %s", path, summarize(primary), summarize(shadow)))
+}
+
+// summarize shortens a JSON value for a log line.
+func summarize(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "missing"
+	case map[string]interface{}:
+		return fmt.Sprintf("object with %d keys", len(v))
+	case []interface{}:
+		return fmt.Sprintf("array of %d", len(v))
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Test that read-only directives are mirrored and differences logged
+func TestHandleRequest_Shadow(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:       "http://primary.example",
+		ShadowBaseURL: "http://shadow.example",
+		ShadowTimeout: time.Second,
+	})
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "shadow.example" {
+			return stubResponse(http.StatusOK, `{"event":{"header":{"messageId":"b"},"payload":{"endpoints":[{"endpointId":"light.kitchen"}]}}}`), nil
+		}
+		return stubResponse(http.StatusOK, `{"event":{"header":{"messageId":"a"},"payload":{"endpoints":[{"endpointId":"light.hall"}]}}}`), nil
+	})
+	core, logs := observer.New(zap.InfoLevel)
+	handler.Logger = zap.New(core)
+
+	response, err := handler.HandleRequest(context.Background(), discoveryEvent())
+	if err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if !strings.Contains(string(mustJSON(response)), "light.hall") {
+		t.Errorf("Expected the primary's response, got %v", response)
+	}
+
+	mismatches := logs.FilterMessageSnippet("Shadow mismatch").All()
+	if len(mismatches) != 1 {
+		t.Fatalf("Expected 1 mismatch, got %d", len(mismatches))
+	}
+	if msg := mismatches[0].Message; !strings.Contains(msg, ".event.payload.endpoints[0].endpointId: light.hall vs light.kitchen") || strings.Contains(msg, "messageId") {
+		t.Errorf("Unexpected mismatch: %s", msg)
+	}
+}
+
+// Test that a routed tenant's directives are not mirrored to the shadow
+func TestHandleRequest_ShadowSkipsTenants(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:       "http://primary.example",
+		ShadowBaseURL: "http://shadow.example",
+		ShadowTimeout: time.Second,
+	})
+	handler.routes = fileRoutes{"amzn1.account.first": {Tenant: "first", BaseURL: "http://first.example", Token: "first-ha-token"}}
+	handler.accounts = testAccounts{"access-token-from-skill": "amzn1.account.first"}
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host != "first.example" {
+			t.Errorf("Unexpected request to %s", req.URL.Host)
+		}
+		return stubResponse(http.StatusOK, `{"event":{"header":{"messageId":"a"},"payload":{"endpoints":[]}}}`), nil
+	})
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+}
+
+func TestDirectiveInfo_IsReadOnly(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		info     directiveInfo
+		expected bool
+	}{
+		{directiveInfo{Namespace: "Alexa.Discovery", Name: "Discover"}, true},
+		{directiveInfo{Namespace: "Alexa", Name: "ReportState"}, true},
+		{directiveInfo{Namespace: "Alexa.PowerController", Name: "TurnOn"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.info.isReadOnly(); got != tt.expected {
+			t.Errorf("%s.%s: expected %v, got %v", tt.info.Namespace, tt.info.Name, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// How long server mode waits for in-flight directives on shutdown.
+const drainTimeout = 10 * time.Second
+
+// Lambda allows 500ms after SIGTERM, see logout in shutdown.
+const logoutTimeout = 400 * time.Millisecond
+
+// shutdown leaves the tailnet and flushes the logger. It runs once, on
+// SIGTERM from the Lambda runtime or when server mode stops. The proxy holds
+// no other long-lived connections.
+func (h *LambdaHandler) shutdown() {
+	h.shutdownOnce.Do(func() {
+		h.Logger.Sugar().Info("Shutting down")
+		if h.TSNetServer != nil && h.config.TSNodePerEnvironment {
+			h.logout()
+		}
+		if h.TSNetServer != nil {
+			if err := h.TSNetServer.Close(); err != nil {
+				h.Logger.Sugar().Warnf("Error closing tailnet: %v", err)
+			}
+		}
+		h.Logger.Sync()
+	})
+}
+
+// logout removes a per-environment node from the tailnet right away. Should
+// it not finish in time, the control server still removes the ephemeral node
+// once it has been offline for a while.
+func (h *LambdaHandler) logout() {
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+	lc, err := h.TSNetServer.LocalClient()
+	if err == nil {
+		err = lc.Logout(ctx)
+	}
+	if err != nil {
+		h.Logger.Sugar().Warnf("Error removing the tailnet node: %v", err)
+	}
+}
+
+// listenUntilSignal serves srv until ctx, which serve cancels on SIGTERM or
+// SIGINT, is done, then stops accepting connections and waits up to
+// drainTimeout for in-flight requests.
+func listenUntilSignal(ctx context.Context, srv *http.Server) error {
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
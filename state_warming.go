@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// State requests in flight while warming
+	warmConcurrency = 4
+	// Discovery waits at most this long for the warming
+	warmBudget = 2 * time.Second
+	// Warmed states are served once within this age
+	warmTTL = time.Minute
+)
+
+// warmStates prefetches the state of the endpoints in a discovery response
+// and caches it, so the ReportState burst the Alexa app sends right after
+// discovery is answered without a round trip to Home Assistant. Endpoints
+// not done within warmBudget are left to Home Assistant.
+func (h *LambdaHandler) warmStates(ctx context.Context, info directiveInfo, target upstream, discovery map[string]interface{}) {
+	event, _ := discovery["event"].(map[string]interface{})
+	payload, _ := event["payload"].(map[string]interface{})
+	endpoints, _ := payload["endpoints"].([]interface{})
+	if len(endpoints) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, warmBudget)
+	defer cancel()
+	sem := make(chan struct{}, warmConcurrency)
+	var wg sync.WaitGroup
+	var warmed atomic.Int32
+	for _, e := range endpoints {
+		endpoint, _ := e.(map[string]interface{})
+		endpointID, ok := endpoint["endpointId"].(string)
+		if !ok {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if h.warmState(ctx, info, target, endpointID, endpoint["cookie"]) {
+				warmed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	h.logger(ctx).Sugar().Infof("Warmed the state of %d of %d endpoints", warmed.Load(), len(endpoints))
+}
+
+// warmState fetches the state of one endpoint with a ReportState directive
+// and caches it for one answer.
+func (h *LambdaHandler) warmState(ctx context.Context, info directiveInfo, target upstream, endpointID string, cookie interface{}) bool {
+	endpoint := map[string]interface{}{
+		"endpointId": endpointID,
+		"scope":      map[string]interface{}{"type": "BearerToken", "token": info.ScopeToken},
+	}
+	if cookie != nil {
+		endpoint["cookie"] = cookie
+	}
+	directive := map[string]interface{}{
+		"directive": map[string]interface{}{
+			"header": map[string]interface{}{
+				"namespace":        "Alexa",
+				"name":             "ReportState",
+				"payloadVersion":   "3",
+				"messageId":        newMessageID(),
+				"correlationToken": newMessageID(),
+			},
+			"endpoint": endpoint,
+			"payload":  map[string]interface{}{},
+		},
+	}
+	body, err := json.Marshal(directive)
+	if err != nil {
+		return false
+	}
+	response, err := h.forward(ctx, target, body)
+	if err != nil {
+		h.logger(ctx).Sugar().Debugf("Error warming the state of %q: %v", endpointID, err)
+		return false
+	}
+	if h.config.ResponseStrip != nil {
+		h.config.ResponseStrip.apply(response)
+	}
+	h.states.warm(directiveInfo{ScopeToken: info.ScopeToken, EndpointID: endpointID}, response, time.Now())
+	return true
+}
+
+// warmReport answers a ReportState from a warmed state, at most once.
+func (h *LambdaHandler) warmReport(ctx context.Context, info directiveInfo, event map[string]interface{}, now time.Time) (map[string]interface{}, bool) {
+	state, ok := h.states.takeWarm(info, now.Add(-warmTTL))
+	if !ok {
+		return nil, false
+	}
+	h.logger(ctx).Sugar().Infof("Serving the state of %q from the warmed cache", info.EndpointID)
+
+	directive, _ := event["directive"].(map[string]interface{})
+	response := map[string]interface{}{
+		"header":  eventHeader(directive, "Alexa", "StateReport"),
+		"payload": map[string]interface{}{},
+	}
+	if endpoint, ok := directive["endpoint"].(map[string]interface{}); ok {
+		response["endpoint"] = endpoint
+	}
+	return map[string]interface{}{
+		"event":   response,
+		"context": map[string]interface{}{"properties": state.properties},
+	}, true
+}
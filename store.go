@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// ErrNotFound is returned by a StateStore for a key without a value.
+var ErrNotFound = errors.New("not found")
+
+// StateStore persists small values by key. It backs the tailnet node state
+// and exchanged tokens, so one STATE_STORE setting decides where everything
+// durable lives.
+type StateStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+// TokenStore persists tokens with their expiry.
+type TokenStore interface {
+	GetToken(ctx context.Context, key string) (token string, expires time.Time, err error)
+	PutToken(ctx context.Context, key, token string, expires time.Time) error
+}
+
+// newStateStore builds the store selected by STATE_STORE:
+//
+//	memory
+//	s3://bucket/prefix
+//	dynamodb:table
+//	ssm:/parameter/prefix
+//
+// It returns nil when unset, leaving state in local files. A namespace,
+// such as the stage, prefixes every key so deployments can share a store.
+func newStateStore(ctx context.Context, spec, namespace string) (StateStore, error) {
+	store, err := openStateStore(ctx, spec)
+	if store == nil || err != nil || namespace == "" {
+		return store, err
+	}
+	return prefixedStore{store: store, prefix: namespace + "/"}, nil
+}
+
+func openStateStore(ctx context.Context, spec string) (StateStore, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if spec == "memory" {
+		return newMemoryStore(), nil
+	}
+
+	var kind, location string
+	if rest, ok := strings.CutPrefix(spec, "s3://"); ok {
+		kind, location = "s3", rest
+	} else {
+		kind, location, _ = strings.Cut(spec, ":")
+	}
+	if location == "" {
+		return nil, fmt.Errorf("invalid STATE_STORE %q", spec)
+	}
+
+	switch kind {
+	case "s3", "dynamodb", "ssm":
+	default:
+		return nil, fmt.Errorf("invalid STATE_STORE %q: unknown store %q", spec, kind)
+	}
+	client, err := newAWSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "s3":
+		bucket, prefix, _ := strings.Cut(location, "/")
+		return &s3Store{client: client, bucket: bucket, prefix: prefix}, nil
+	case "dynamodb":
+		return &dynamoStore{client: client, table: location}, nil
+	default:
+		return &ssmStore{client: client, prefix: strings.TrimRight(location, "/")}, nil
+	}
+}
+
+type prefixedStore struct {
+	store  StateStore
+	prefix string
+}
+
+func (s prefixedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.store.Get(ctx, s.prefix+key)
+}
+
+func (s prefixedStore) Put(ctx context.Context, key string, value []byte) error {
+	return s.store.Put(ctx, s.prefix+key, value)
+}
+
+type memoryStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	locks  map[string]memoryLock
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{values: make(map[string][]byte), locks: make(map[string]memoryLock)}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// s3Store keeps each value in an object under prefix.
+type s3Store struct {
+	client *awsClient
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) objectKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return strings.TrimRight(s.prefix, "/") + "/" + key
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.client.getObject(ctx, s.bucket, s.objectKey(key))
+	var awsErr *awsError
+	if errors.As(err, &awsErr) && awsErr.status == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, value []byte) error {
+	return s.client.putObject(ctx, s.bucket, s.objectKey(key), "application/octet-stream", value)
+}
+
+// dynamoStore keeps values in a table with string partition key "key" and a
+// binary "value" attribute.
+type dynamoStore struct {
+	client *awsClient
+	table  string
+}
+
+type dynamoBinary struct {
+	B []byte `json:"B"`
+}
+
+func (s *dynamoStore) Get(ctx context.Context, key string) ([]byte, error) {
+	in := map[string]interface{}{
+		"TableName":      s.table,
+		"Key":            map[string]dynamoString{"key": {S: key}},
+		"ConsistentRead": true,
+	}
+	var out struct {
+		Item struct {
+			Value *dynamoBinary `json:"value"`
+		} `json:"Item"`
+	}
+	if err := s.client.callJSON(ctx, "dynamodb", "1.0", "DynamoDB_20120810.GetItem", in, &out); err != nil {
+		return nil, err
+	}
+	if out.Item.Value == nil {
+		return nil, ErrNotFound
+	}
+	return out.Item.Value.B, nil
+}
+
+func (s *dynamoStore) Put(ctx context.Context, key string, value []byte) error {
+	in := map[string]interface{}{
+		"TableName": s.table,
+		"Item": map[string]interface{}{
+			"key":   dynamoString{S: key},
+			"value": dynamoBinary{B: value},
+		},
+	}
+	return s.client.callJSON(ctx, "dynamodb", "1.0", "DynamoDB_20120810.PutItem", in, nil)
+}
+
+// ssmStore keeps values base64 encoded in SecureString parameters under
+// prefix. Values over 4KB need the advanced tier, which SSM picks
+// automatically with Intelligent-Tiering.
+type ssmStore struct {
+	client *awsClient
+	prefix string
+}
+
+func (s *ssmStore) name(key string) string {
+	// Parameter names allow a-zA-Z0-9_.-/
+	return s.prefix + "/" + strings.NewReplacer(":", "_", "+", "_").Replace(key)
+}
+
+func (s *ssmStore) Get(ctx context.Context, key string) ([]byte, error) {
+	in := map[string]interface{}{"Name": s.name(key), "WithDecryption": true}
+	var out struct {
+		Parameter ssmParameter `json:"Parameter"`
+	}
+	err := s.client.callJSON(ctx, "ssm", "1.1", "AmazonSSM.GetParameter", in, &out)
+	var awsErr *awsError
+	if errors.As(err, &awsErr) && strings.Contains(awsErr.body, "ParameterNotFound") {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Parameter.Value)
+}
+
+func (s *ssmStore) Put(ctx context.Context, key string, value []byte) error {
+	in := map[string]interface{}{
+		"Name":      s.name(key),
+		"Value":     base64.StdEncoding.EncodeToString(value),
+		"Type":      "SecureString",
+		"Overwrite": true,
+		"Tier":      "Intelligent-Tiering",
+	}
+	return s.client.callJSON(ctx, "ssm", "1.1", "AmazonSSM.PutParameter", in, nil)
+}
+
+// tokenStore stores tokens as JSON values of a StateStore under "tokens/".
+type tokenStore struct {
+	store StateStore
+}
+
+func (s tokenStore) GetToken(ctx context.Context, key string) (string, time.Time, error) {
+	data, err := s.store.Get(ctx, "tokens/"+tokenHash(key))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var token cachedToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", time.Time{}, err
+	}
+	return token.Value, token.Expires, nil
+}
+
+func (s tokenStore) PutToken(ctx context.Context, key, token string, expires time.Time) error {
+	data, err := json.Marshal(cachedToken{Value: token, Expires: expires})
+	if err != nil {
+		return err
+	}
+	return s.store.Put(ctx, "tokens/"+tokenHash(key), data)
+}
+
+// Bound on each tailnet state read or write, tsnet's store interface has no
+// context.
+const ipnStoreTimeout = 5 * time.Second
+
+// ipnStore adapts a StateStore to the tsnet node state under "tailscale/".
+type ipnStore struct {
+	store StateStore
+}
+
+func (s ipnStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ipnStoreTimeout)
+	defer cancel()
+	value, err := s.store.Get(ctx, "tailscale/"+string(id))
+	if errors.Is(err, ErrNotFound) {
+		return nil, ipn.ErrStateNotExist
+	}
+	return value, err
+}
+
+func (s ipnStore) WriteState(id ipn.StateKey, bs []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ipnStoreTimeout)
+	defer cancel()
+	return s.store.Put(ctx, "tailscale/"+string(id), bs)
+}
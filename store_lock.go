@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// A lock outlives a holder that died at most this long. A live holder
+	// renews it every third of that until it releases it, however long
+	// registration takes.
+	stateLockTTL = 30 * time.Second
+	// How often a waiter tries to take the lock
+	stateLockPoll = 200 * time.Millisecond
+	// How long a cold start waits for the lock, enough for the lock of a
+	// holder that died to expire
+	stateLockWait = stateLockTTL + 5*time.Second
+)
+
+var errLockUnsupported = errors.New("store does not support locking")
+
+// Locker is implemented by stores that can take a lease on a key with a
+// conditional write, for things only one execution environment may do at a
+// time.
+type Locker interface {
+	// TryLock takes the lock on key for owner until ttl passes and reports
+	// whether it succeeded. An expired lock may be taken over.
+	TryLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	Unlock(ctx context.Context, key, owner string) error
+}
+
+// lockState waits for the lock on key in store and holds it, renewing it
+// before ttl passes. Stores without locking are used unlocked. The returned
+// function stops the renewal and releases the lock.
+func lockState(ctx context.Context, store StateStore, key string, ttl time.Duration) (func(), error) {
+	locker, ok := store.(Locker)
+	if !ok {
+		return func() {}, nil
+	}
+	owner := newMessageID()
+	for {
+		locked, err := locker.TryLock(ctx, key, owner, ttl)
+		if errors.Is(err, errLockUnsupported) {
+			return func() {}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("locking %s: %w", key, err)
+		}
+		if locked {
+			stop := make(chan struct{})
+			renewed := make(chan struct{})
+			go renewLock(locker, key, owner, ttl, stop, renewed)
+			return func() {
+				close(stop)
+				<-renewed
+				// An unreleased lock expires after ttl
+				ctx, cancel := context.WithTimeout(context.Background(), ipnStoreTimeout)
+				defer cancel()
+				locker.Unlock(ctx, key, owner)
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for the lock on %s: %w", key, ctx.Err())
+		case <-time.After(stateLockPoll):
+		}
+	}
+}
+
+// renewLock takes the lock owner holds again every third of ttl until stop
+// is closed. A failed renewal is retried on the next tick while the lock
+// hasn't expired.
+func renewLock(locker Locker, key, owner string, ttl time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), min(ttl/3, ipnStoreTimeout))
+			locker.TryLock(ctx, key, owner, ttl)
+			cancel()
+		}
+	}
+}
+
+func (s prefixedStore) TryLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	locker, ok := s.store.(Locker)
+	if !ok {
+		return false, errLockUnsupported
+	}
+	return locker.TryLock(ctx, s.prefix+key, owner, ttl)
+}
+
+func (s prefixedStore) Unlock(ctx context.Context, key, owner string) error {
+	locker, ok := s.store.(Locker)
+	if !ok {
+		return errLockUnsupported
+	}
+	return locker.Unlock(ctx, s.prefix+key, owner)
+}
+
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+func (s *memoryStore) TryLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if lock, ok := s.locks[key]; ok && lock.owner != owner && now.Before(lock.expires) {
+		return false, nil
+	}
+	s.locks[key] = memoryLock{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryStore) Unlock(ctx context.Context, key, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks[key].owner == owner {
+		delete(s.locks, key)
+	}
+	return nil
+}
+
+type dynamoNumber struct {
+	N string `json:"N"`
+}
+
+// TryLock writes an item with the owner and expiry under "lock/<key>",
+// conditional on there being none, an expired one or one of owner's.
+func (s *dynamoStore) TryLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	in := map[string]interface{}{
+		"TableName": s.table,
+		"Item": map[string]interface{}{
+			"key":     dynamoString{S: "lock/" + key},
+			"owner":   dynamoString{S: owner},
+			"expires": dynamoNumber{N: strconv.FormatInt(now.Add(ttl).UnixMilli(), 10)},
+		},
+		"ConditionExpression":      "attribute_not_exists(#key) OR expires < :now OR #owner = :owner",
+		"ExpressionAttributeNames": map[string]string{"#key": "key", "#owner": "owner"},
+		"ExpressionAttributeValues": map[string]interface{}{
+			":now":   dynamoNumber{N: strconv.FormatInt(now.UnixMilli(), 10)},
+			":owner": dynamoString{S: owner},
+		},
+	}
+	err := s.client.callJSON(ctx, "dynamodb", "1.0", "DynamoDB_20120810.PutItem", in, nil)
+	var awsErr *awsError
+	if errors.As(err, &awsErr) && strings.Contains(awsErr.body, "ConditionalCheckFailedException") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *dynamoStore) Unlock(ctx context.Context, key, owner string) error {
+	in := map[string]interface{}{
+		"TableName":                 s.table,
+		"Key":                       map[string]dynamoString{"key": {S: "lock/" + key}},
+		"ConditionExpression":       "#owner = :owner",
+		"ExpressionAttributeNames":  map[string]string{"#owner": "owner"},
+		"ExpressionAttributeValues": map[string]dynamoString{":owner": {S: owner}},
+	}
+	return s.client.callJSON(ctx, "dynamodb", "1.0", "DynamoDB_20120810.DeleteItem", in, nil)
+}
+
+// TryLock keeps "<owner> <expiry>" in the parameter "lock/<key>". A missing
+// one is created without Overwrite, which fails if it exists. An expired or
+// released one is taken over by overwriting it, and the taker holds the lock
+// only if its write made the version right after the one it saw expire; of
+// several waiters overwriting the same expired lock only the first does.
+// The parameter is never deleted, so versions are never reused.
+func (s *ssmStore) TryLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	name := s.name("lock/" + key)
+	holder, expires, version, err := s.lockHolder(ctx, name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if err == nil && holder != owner && time.Now().UnixMilli() < expires {
+		return false, nil
+	}
+
+	in := map[string]interface{}{
+		"Name":      name,
+		"Value":     owner + " " + strconv.FormatInt(time.Now().Add(ttl).UnixMilli(), 10),
+		"Type":      "String",
+		"Overwrite": err == nil,
+	}
+	var out struct {
+		Version int64 `json:"Version"`
+	}
+	err = s.client.callJSON(ctx, "ssm", "1.1", "AmazonSSM.PutParameter", in, &out)
+	var awsErr *awsError
+	if errors.As(err, &awsErr) && strings.Contains(awsErr.body, "ParameterAlreadyExists") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// A waiter that lost the race has still written its own owner, so the
+	// winner's Unlock leaves the lock to expire
+	return out.Version == version+1, nil
+}
+
+// Unlock marks the lock released by setting its expiry to zero.
+func (s *ssmStore) Unlock(ctx context.Context, key, owner string) error {
+	name := s.name("lock/" + key)
+	holder, _, _, err := s.lockHolder(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil || holder != owner {
+		return err
+	}
+	in := map[string]interface{}{
+		"Name":      name,
+		"Value":     owner + " 0",
+		"Type":      "String",
+		"Overwrite": true,
+	}
+	return s.client.callJSON(ctx, "ssm", "1.1", "AmazonSSM.PutParameter", in, nil)
+}
+
+// lockHolder returns the owner and expiry in the lock parameter name and its
+// version.
+func (s *ssmStore) lockHolder(ctx context.Context, name string) (string, int64, int64, error) {
+	var out struct {
+		Parameter struct {
+			Value   string `json:"Value"`
+			Version int64  `json:"Version"`
+		} `json:"Parameter"`
+	}
+	err := s.client.callJSON(ctx, "ssm", "1.1", "AmazonSSM.GetParameter", map[string]string{"Name": name}, &out)
+	var awsErr *awsError
+	if errors.As(err, &awsErr) && strings.Contains(awsErr.body, "ParameterNotFound") {
+		return "", 0, 0, ErrNotFound
+	}
+	if err != nil {
+		return "", 0, 0, err
+	}
+	holder, expiry, _ := strings.Cut(out.Parameter.Value, " ")
+	expires, _ := strconv.ParseInt(expiry, 10, 64)
+	return holder, expires, out.Parameter.Version, nil
+}
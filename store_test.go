@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestMemoryStore_TokensAndTailnetState(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store, err := newStateStore(ctx, "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Node state goes through the tsnet adapter
+	state := ipnStore{store: store}
+	if _, err := state.ReadState("_machinekey"); err != ipn.ErrStateNotExist {
+		t.Errorf("Expected ipn.ErrStateNotExist, got %v", err)
+	}
+	if err := state.WriteState("_machinekey", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := state.ReadState("_machinekey"); err != nil || string(value) != "key" {
+		t.Errorf("Unexpected state %q (%v)", value, err)
+	}
+
+	// An empty local cache falls back to the durable token store
+	tokens := tokenStore{store: store}
+	tokens.PutToken(ctx, "refresh-token", "short-lived", time.Now().Add(time.Hour))
+	cache := newTokenCache("")
+	cache.durable = tokens
+	token, err := cache.fetch(ctx, "refresh-token", func(context.Context) (string, time.Time, error) {
+		t.Error("Expected no exchange")
+		return "", time.Time{}, nil
+	})
+	if err != nil || token != "short-lived" {
+		t.Errorf("Unexpected token %q (%v)", token, err)
+	}
+}
+
+func TestNewStateStore_Invalid(t *testing.T) {
+	t.Parallel()
+	for _, spec := range []string{"redis:cache", "dynamodb:", "s3://"} {
+		if _, err := newStateStore(context.Background(), spec, ""); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+// Test that a second environment waits for the state lock
+func TestLockState(t *testing.T) {
+	t.Parallel()
+	store, err := newStateStore(context.Background(), "memory", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := lockState(context.Background(), store, "tailscale", stateLockTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*stateLockPoll)
+	defer cancel()
+	if _, err := lockState(ctx, store, "tailscale", stateLockTTL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected to time out waiting for the lock, got %v", err)
+	}
+
+	release()
+	release, err = lockState(context.Background(), store, "tailscale", stateLockTTL)
+	if err != nil {
+		t.Fatalf("Expected the released lock to be taken, got %v", err)
+	}
+	release()
+}
+
+// Test that a held lock is renewed past its ttl until it is released
+func TestLockState_Renewed(t *testing.T) {
+	t.Parallel()
+	store, err := newStateStore(context.Background(), "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := 3 * stateLockPoll
+	release, err := lockState(context.Background(), store, "tailscale", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waits well past the first expiry
+	ctx, cancel := context.WithTimeout(context.Background(), 3*ttl)
+	defer cancel()
+	if _, err := lockState(ctx, store, "tailscale", ttl); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the renewed lock to stay held, got %v", err)
+	}
+
+	release()
+	release, err = lockState(context.Background(), store, "tailscale", ttl)
+	if err != nil {
+		t.Fatalf("Expected the released lock to be taken, got %v", err)
+	}
+	release()
+}
+
+// fakeSSM keeps parameters with versions, as far as the lock uses them.
+type fakeSSM struct {
+	mu       sync.Mutex
+	values   map[string]string
+	versions map[string]int64
+	// Called before each PutParameter when set
+	beforePut func()
+}
+
+func (f *fakeSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Name      string
+		Value     string
+		Overwrite bool
+	}
+	json.NewDecoder(r.Body).Decode(&in)
+	target := r.Header.Get("X-Amz-Target")
+	if target == "AmazonSSM.PutParameter" && f.beforePut != nil {
+		f.beforePut()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch target {
+	case "AmazonSSM.GetParameter":
+		if _, ok := f.values[in.Name]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ParameterNotFound"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Parameter": map[string]interface{}{"Value": f.values[in.Name], "Version": f.versions[in.Name]}})
+	case "AmazonSSM.PutParameter":
+		if _, ok := f.values[in.Name]; ok && !in.Overwrite {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ParameterAlreadyExists"}`))
+			return
+		}
+		f.values[in.Name] = in.Value
+		f.versions[in.Name]++
+		json.NewEncoder(w).Encode(map[string]interface{}{"Version": f.versions[in.Name]})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Test that of several cold starts finding an expired lock only one takes it
+func TestSSMStore_LockTakeover(t *testing.T) {
+	t.Parallel()
+	ssm := &fakeSSM{values: make(map[string]string), versions: make(map[string]int64)}
+	store := &ssmStore{client: fakeAWS(t, ssm), prefix: "/hass-proxy"}
+	ctx := context.Background()
+
+	if ok, err := store.TryLock(ctx, "tailscale", "dead", -time.Second); !ok || err != nil {
+		t.Fatalf("Expected the first lock to be taken, got %v, %v", ok, err)
+	}
+
+	// Every waiter sees the expired lock before any of them overwrites it
+	const waiters = 5
+	var seen sync.WaitGroup
+	seen.Add(waiters)
+	ssm.beforePut = func() {
+		seen.Done()
+		seen.Wait()
+	}
+	var wg sync.WaitGroup
+	var taken atomic.Int32
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			ok, err := store.TryLock(ctx, "tailscale", owner, time.Minute)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				taken.Add(1)
+			}
+		}(fmt.Sprintf("waiter-%d", i))
+	}
+	wg.Wait()
+	if taken.Load() != 1 {
+		t.Errorf("Expected exactly one waiter to take the expired lock, got %d", taken.Load())
+	}
+
+	ssm.beforePut = nil
+	if ok, _ := store.TryLock(ctx, "tailscale", "late", time.Minute); ok {
+		t.Error("Expected the taken lock to be held")
+	}
+}
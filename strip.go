@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stripRules shrink responses for large installations, keyed by field name
+// wherever it appears. A limit of -1 drops the field. Otherwise strings are
+// truncated to limit runes and other values are dropped when their JSON is
+// larger than limit bytes.
+type stripRules map[string]int
+
+// parseStripRules parses RESPONSE_STRIP, e.g.
+// "additionalAttributes,description=64,cookie=512".
+func parseStripRules(value string) (stripRules, error) {
+	if value == "" {
+		return nil, nil
+	}
+	rules := make(stripRules)
+	for _, rule := range strings.Split(value, ",") {
+		name, limit, hasLimit := strings.Cut(strings.TrimSpace(rule), "=")
+		if name == "" {
+			return nil, fmt.Errorf("invalid RESPONSE_STRIP: empty field in %q", value)
+		}
+		if !hasLimit {
+			rules[name] = -1
+			continue
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid RESPONSE_STRIP: limit for %s: %q", name, limit)
+		}
+		rules[name] = n
+	}
+	return rules, nil
+}
+
+// apply strips v in place.
+func (r stripRules) apply(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			limit, ok := r[key]
+			if !ok {
+				r.apply(value)
+				continue
+			}
+			if limit < 0 {
+				delete(v, key)
+				continue
+			}
+			if s, ok := value.(string); ok {
+				if runes := []rune(s); len(runes) > limit {
+					v[key] = string(runes[:limit])
+				}
+				continue
+			}
+			if data, err := json.Marshal(value); err != nil || len(data) > limit {
+				delete(v, key)
+				continue
+			}
+			r.apply(value)
+		}
+	case []interface{}:
+		for _, value := range v {
+			r.apply(value)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStripRules(t *testing.T) {
+	t.Parallel()
+	rules, err := parseStripRules("additionalAttributes, description=5, cookie=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	json.Unmarshal([]byte(`{"event":{"payload":{"endpoints":[
+		{"endpointId":"a","description":"A long description","additionalAttributes":{"model":"x"},"cookie":{"small":"1"}},
+		{"endpointId":"b","description":"Short","cookie":{"large":"0123456789012345678901234567890"}}
+	]}}}`), &response)
+
+	rules.apply(response)
+	got, _ := json.Marshal(response)
+	expected := `{"event":{"payload":{"endpoints":[{"cookie":{"small":"1"},"description":"A lon","endpointId":"a"},{"description":"Short","endpointId":"b"}]}}}`
+	if string(got) != expected {
+		t.Errorf("Unexpected response\n got:      %s\n expected: %s", got, expected)
+	}
+
+	if _, err := parseStripRules("cookie=big"); err == nil {
+		t.Error("Expected an invalid limit to be rejected")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Log lines kept for a support bundle.
+const recentLogLines = 500
+
+// logRing keeps the most recent log lines in JSON, whatever LOG_FORMAT is,
+// with tokens redacted.
+type logRing struct {
+	mu    sync.Mutex
+	lines [][]byte
+	next  int
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([][]byte, 0, size)}
+}
+
+// Bearer tokens in logged events, e.g. "token:abc" from %+v
+var loggedToken = regexp.MustCompile(`(?i)(token"?\s*[:=]\s*"?)[^\s,"}\]]+`)
+
+func (r *logRing) Write(p []byte) (int, error) {
+	line := loggedToken.ReplaceAll(p, []byte("${1}REDACTED"))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) < cap(r.lines) {
+		r.lines = append(r.lines, line)
+	} else {
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % len(r.lines)
+	}
+	return len(p), nil
+}
+
+func (r *logRing) Sync() error { return nil }
+
+// contents returns the kept lines, oldest first.
+func (r *logRing) contents() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var buf bytes.Buffer
+	for i := range r.lines {
+		buf.Write(r.lines[(r.next+i)%len(r.lines)])
+	}
+	return buf.Bytes()
+}
+
+// tee adds the ring to a logger's core at the same level.
+func (r *logRing) tee(core zapcore.Core) zapcore.Core {
+	encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	return zapcore.NewTee(core, zapcore.NewCore(encoder, r, core))
+}
+
+// isSupportBundle returns where an event asks the support bundle to be
+// written, e.g. {"supportBundle": "s3://bucket/prefix/"}.
+func isSupportBundle(event map[string]interface{}) (string, bool) {
+	dest, ok := event["supportBundle"].(string)
+	return dest, ok
+}
+
+// writeSupportBundle gathers what a bug report needs into a .tar.gz at dest,
+// a local path or s3://bucket/key; a dest ending in / gets a generated name.
+// It returns where the bundle went.
+//
+// Secrets in the configuration are redacted. Tailnet status lists the
+// node's peers by name and address.
+func (h *LambdaHandler) writeSupportBundle(ctx context.Context, dest string) (string, error) {
+	files := map[string][]byte{
+		"config.json":      mustIndent(redactedConfig(h.config)),
+		"version.json":     mustIndent(versionInfo()),
+		"logs.jsonl":       h.recentLogs.contents(),
+		"diagnostics.json": mustIndent(h.runDiagnostics(ctx)),
+	}
+	if h.TSNetServer != nil {
+		if lc, err := h.TSNetServer.LocalClient(); err != nil {
+			files["tailnet-error.txt"] = []byte(err.Error())
+		} else if status, err := lc.Status(ctx); err != nil {
+			files["tailnet-error.txt"] = []byte(err.Error())
+		} else {
+			files["tailnet-status.json"] = mustIndent(status)
+			// The reachability report of the home DERP region stands in for
+			// netcheck, which tsnet doesn't offer
+			if status.Self != nil && status.Self.Relay != "" {
+				report, err := lc.DebugDERPRegion(ctx, status.Self.Relay)
+				if err != nil {
+					files["derp-error.txt"] = []byte(err.Error())
+				} else {
+					files["derp.json"] = mustIndent(report)
+				}
+			}
+		}
+	}
+
+	archive, err := tarGz(files)
+	if err != nil {
+		return "", err
+	}
+	if dest == "" || strings.HasSuffix(dest, "/") {
+		dest += "support-bundle-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	}
+	if rest, ok := strings.CutPrefix(dest, "s3://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		client, err := newAWSClient(ctx)
+		if err != nil {
+			return "", err
+		}
+		return dest, client.putObject(ctx, bucket, key, "application/gzip", archive)
+	}
+	return dest, os.WriteFile(dest, archive, 0o600)
+}
+
+// redactedConfig returns cfg as JSON fields with every token and key
+// replaced.
+func redactedConfig(cfg Config) map[string]interface{} {
+	data, _ := json.Marshal(cfg)
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	for name, value := range fields {
+		secret := strings.HasSuffix(name, "Token") || strings.HasSuffix(name, "AuthKey") || strings.HasSuffix(name, "Secret")
+		if secret && value != "" {
+			fields[name] = "REDACTED"
+		}
+	}
+	return fields
+}
+
+func versionInfo() map[string]string {
+	info := map[string]string{
+		"go":       runtime.Version(),
+		"platform": runtime.GOOS + "/" + runtime.GOARCH,
+		"runtime":  os.Getenv("AWS_EXECUTION_ENV"),
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info["version"] = build.Main.Version
+	for _, setting := range build.Settings {
+		if setting.Key == "vcs.revision" || setting.Key == "vcs.time" {
+			info[setting.Key] = setting.Value
+		}
+	}
+	for _, dep := range build.Deps {
+		if dep.Path == "tailscale.com" {
+			info["tailscale"] = dep.Version
+		}
+	}
+	return info
+}
+
+func mustIndent(v interface{}) []byte {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return []byte(fmt.Sprintf("error: %v", err))
+	}
+	return data
+}
+
+func tarGz(files map[string][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for name, data := range files {
+		header := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Test that the bundle holds redacted config and logs
+func TestHandleRequest_SupportBundle(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", LongLivedToken: "secret-token"})
+	handler.HTTPClient = doerFunc(func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+	core, _ := observer.New(zap.InfoLevel)
+	handler.Logger = zap.New(handler.recentLogs.tee(core))
+	handler.Logger.Sugar().Infof("Event: map[scope:map[token:access-token-from-skill type:BearerToken]]")
+
+	dir := t.TempDir() + "/"
+	response, err := handler.HandleRequest(context.Background(), map[string]interface{}{"supportBundle": dir})
+	if err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	location, _ := response["supportBundle"].(string)
+	if filepath.Dir(location) != filepath.Clean(dir) {
+		t.Fatalf("Expected a bundle in %s, got %v", dir, response)
+	}
+
+	f, err := os.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[header.Name] = string(data)
+	}
+
+	for _, name := range []string{"config.json", "version.json", "logs.jsonl", "diagnostics.json"} {
+		if files[name] == "" {
+			t.Errorf("Expected %s in the bundle", name)
+		}
+	}
+	for name, data := range files {
+		if strings.Contains(data, "secret-token") || strings.Contains(data, "access-token-from-skill") {
+			t.Errorf("Expected tokens redacted in %s:\n%s", name, data)
+		}
+	}
+	if !strings.Contains(files["logs.jsonl"], "token:REDACTED") {
+		t.Errorf("Expected the logged event, got:\n%s", files["logs.jsonl"])
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNamespaceDisabled = errors.New("directive namespace not enabled for this account")
+
+// tenantSource loads the raw settings of one tenant, keyed by the last path
+// element of each parameter.
+type tenantSource interface {
+	load(ctx context.Context, tenant string) (map[string]string, error)
+}
+
+// ssmTenantSource reads parameters under {prefix}/{tenant}/.
+type ssmTenantSource struct {
+	client *awsClient
+	prefix string
+}
+
+type ssmParameter struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+func (s *ssmTenantSource) load(ctx context.Context, tenant string) (map[string]string, error) {
+	settings := make(map[string]string)
+	in := map[string]interface{}{
+		"Path":           strings.TrimRight(s.prefix, "/") + "/" + tenant + "/",
+		"WithDecryption": true,
+	}
+	for {
+		var out struct {
+			Parameters []ssmParameter `json:"Parameters"`
+			NextToken  string         `json:"NextToken"`
+		}
+		if err := s.client.callJSON(ctx, "ssm", "1.1", "AmazonSSM.GetParametersByPath", in, &out); err != nil {
+			return nil, err
+		}
+		for _, p := range out.Parameters {
+			settings[path.Base(p.Name)] = p.Value
+		}
+		if out.NextToken == "" {
+			return settings, nil
+		}
+		in["NextToken"] = out.NextToken
+	}
+}
+
+// tenantConfigs caches tenant settings and reloads them once they are older
+// than ttl, so changes in SSM apply without a redeploy. When a reload fails
+// the previous settings stay in use.
+type tenantConfigs struct {
+	source tenantSource
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]tenantConfigEntry
+}
+
+type tenantConfigEntry struct {
+	settings map[string]string
+	loaded   time.Time
+}
+
+func newTenantConfigs(source tenantSource, ttl time.Duration) *tenantConfigs {
+	return &tenantConfigs{source: source, ttl: ttl, entries: make(map[string]tenantConfigEntry)}
+}
+
+func (c *tenantConfigs) get(ctx context.Context, tenant string) (map[string]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[tenant]
+	c.mu.Unlock()
+	if ok && time.Since(entry.loaded) < c.ttl {
+		return entry.settings, nil
+	}
+
+	settings, err := c.source.load(ctx, tenant)
+	if err != nil {
+		if ok {
+			return entry.settings, nil
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[tenant] = tenantConfigEntry{settings: settings, loaded: time.Now()}
+	c.mu.Unlock()
+	return settings, nil
+}
+
+// tenantConfigsFor builds the tenant settings cache selected by
+// TENANT_SSM_PREFIX, or nil when tenants have no settings of their own.
+func tenantConfigsFor(ctx context.Context, cfg Config) (*tenantConfigs, error) {
+	if cfg.TenantSSMPrefix == "" {
+		return nil, nil
+	}
+	client, err := newAWSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newTenantConfigs(&ssmTenantSource{client: client, prefix: cfg.TenantSSMPrefix}, cfg.TenantConfigTTL), nil
+}
+
+// applyTenantConfig overrides target with the settings of its tenant:
+// base_url, token, timeout (a Go duration), namespaces (a comma separated
+// list of directive namespaces the tenant may use) and rate_limit (requests
+// per minute).
+func (h *LambdaHandler) applyTenantConfig(ctx context.Context, target upstream) (upstream, error) {
+	if h.tenants == nil || target.Tenant == "" {
+		return target, nil
+	}
+	settings, err := h.tenants.get(ctx, target.Tenant)
+	if err != nil {
+		h.logger(ctx).Sugar().Errorf("Error loading settings for tenant %s: %v", target.Tenant, err)
+		return upstream{}, fmt.Errorf("internal server error")
+	}
+
+	if baseURL := settings["base_url"]; baseURL != "" {
+		target.BaseURL = strings.TrimRight(baseURL, "/")
+	}
+	if token := settings["token"]; token != "" {
+		target.Token = token
+	}
+	if timeout := settings["timeout"]; timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			h.logger(ctx).Sugar().Warnf("Ignoring invalid timeout for tenant %s: %v", target.Tenant, err)
+		} else {
+			target.Timeout = d
+		}
+	}
+	if namespaces := settings["namespaces"]; namespaces != "" {
+		target.Namespaces = strings.Split(namespaces, ",")
+	}
+	if value := settings["rate_limit"]; value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			h.logger(ctx).Sugar().Warnf("Ignoring invalid rate_limit for tenant %s: %v", target.Tenant, err)
+		} else {
+			target.RateLimit = n
+		}
+	}
+	return target, nil
+}
+
+// allows reports whether a directive namespace passes the tenant's filter.
+func (u upstream) allows(namespace string) bool {
+	if len(u.Namespaces) == 0 {
+		return true
+	}
+	for _, allowed := range u.Namespaces {
+		if strings.TrimSpace(allowed) == namespace {
+			return true
+		}
+	}
+	return false
+}
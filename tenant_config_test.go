@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type tenantSourceFunc func(ctx context.Context, tenant string) (map[string]string, error)
+
+func (f tenantSourceFunc) load(ctx context.Context, tenant string) (map[string]string, error) {
+	return f(ctx, tenant)
+}
+
+// Test that tenant settings override the route and are reloaded after the TTL
+func TestHandleRequest_TenantConfig(t *testing.T) {
+	t.Parallel()
+	var gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		json.NewEncoder(w).Encode(map[string]interface{}{"event": map[string]interface{}{}})
+	}))
+	defer upstream.Close()
+
+	routes := writeRoutesFile(t, map[string]interface{}{
+		"amzn1.account.home": map[string]string{"tenant": "home", "baseUrl": "http://unused.example"},
+	})
+	handler := newTestHandler(t, Config{RoutesFile: routes})
+	handler.accounts = testAccounts{"access-token-from-skill": "amzn1.account.home"}
+
+	settings := map[string]string{"base_url": upstream.URL, "token": "tenant-token"}
+	loads := 0
+	handler.tenants = newTenantConfigs(tenantSourceFunc(func(ctx context.Context, tenant string) (map[string]string, error) {
+		if tenant != "home" {
+			t.Errorf("Expected tenant home, got %q", tenant)
+		}
+		loads++
+		if loads > 2 {
+			return nil, errors.New("ssm unavailable")
+		}
+		return settings, nil
+	}), 50*time.Millisecond)
+
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Handler returned an error: %v", err)
+	}
+	if gotAuth != "Bearer tenant-token" {
+		t.Errorf("Expected the tenant token, got %q", gotAuth)
+	}
+
+	// A changed namespace filter applies once the settings are reloaded
+	settings = map[string]string{"base_url": upstream.URL, "namespaces": "Alexa.PowerController"}
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Fatalf("Expected cached settings before the TTL, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != errNamespaceDisabled {
+		t.Errorf("Expected errNamespaceDisabled, got %v", err)
+	}
+
+	// A failed reload keeps the previous settings
+	time.Sleep(100 * time.Millisecond)
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != errNamespaceDisabled {
+		t.Errorf("Expected the previous settings after a failed reload, got %v", err)
+	}
+	if loads != 3 {
+		t.Errorf("Expected 3 loads, got %d", loads)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// requestTiming records when each phase of the upstream request happened.
+type requestTiming struct {
+	mu           sync.Mutex
+	start        time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	reusedConn   bool
+}
+
+// timingBreakdown is the per-phase duration summary in milliseconds.
+type timingBreakdown struct {
+	// Time to bring the tailnet up, only known on a cold start
+	TailnetMs  float64 `json:"tailnetMs,omitempty"`
+	ConnectMs  float64 `json:"connectMs"`
+	TLSMs      float64 `json:"tlsMs"`
+	UpstreamMs float64 `json:"upstreamMs"`
+	TotalMs    float64 `json:"totalMs"`
+	ReusedConn bool    `json:"reusedConn"`
+}
+
+// withTiming returns a context whose outgoing HTTP requests record their
+// phases into the returned requestTiming.
+func withTiming(ctx context.Context) (context.Context, *requestTiming) {
+	t := &requestTiming{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.set(func() { t.reusedConn = info.Reused })
+		},
+		ConnectStart: func(string, string) {
+			t.set(func() { t.connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			t.set(func() { t.connectDone = time.Now() })
+		},
+		TLSHandshakeStart: func() {
+			t.set(func() { t.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.set(func() { t.tlsDone = time.Now() })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.set(func() { t.wroteRequest = time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			t.set(func() { t.firstByte = time.Now() })
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace), t
+}
+
+func (t *requestTiming) set(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f()
+}
+
+// breakdown summarizes the recorded phases up to now.
+func (t *requestTiming) breakdown() timingBreakdown {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return timingBreakdown{
+		ConnectMs:  millis(t.connectStart, t.connectDone),
+		TLSMs:      millis(t.tlsStart, t.tlsDone),
+		UpstreamMs: millis(t.wroteRequest, t.firstByte),
+		TotalMs:    millis(t.start, time.Now()),
+		ReusedConn: t.reusedConn,
+	}
+}
+
+func millis(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+	return float64(to.Sub(from).Microseconds()) / 1000
+}
+
+// logTiming writes the phases of a request at debug level, including the
+// tailnet startup on the first invocation, so the latency of a voice command
+// can be attributed without the UI.
+func (h *LambdaHandler) logTiming(ctx context.Context, timing *requestTiming) {
+	breakdown := timing.breakdown()
+	if h.invocations.Load() == 1 {
+		breakdown.TailnetMs = float64(h.tailnetReady.Microseconds()) / 1000
+	}
+	h.logger(ctx).Debug("Timing",
+		zap.Float64("tailnetMs", breakdown.TailnetMs),
+		zap.Float64("connectMs", breakdown.ConnectMs),
+		zap.Float64("tlsMs", breakdown.TLSMs),
+		zap.Float64("upstreamMs", breakdown.UpstreamMs),
+		zap.Float64("totalMs", breakdown.TotalMs),
+		zap.Bool("reusedConn", breakdown.ReusedConn),
+	)
+}
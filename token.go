@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var errTokenRejected = errors.New("long-lived access token expired or revoked")
+
+// tokenRecheckInterval is how often a rejected token is checked again, so
+// a 401 from a restarting Home Assistant or auth layer doesn't fail every
+// directive until the next cold start.
+const tokenRecheckInterval = time.Minute
+
+// validateToken checks LONG_LIVED_ACCESS_TOKEN, or the token REFRESH_TOKEN
+// is exchanged for, against the HA API at startup. A rejected token puts the
+// handler into an explicit error state instead of letting every directive
+// fail later with a bare 401, until a later check accepts it. An unreachable
+// HA is only logged, it says nothing about the token.
+func (h *LambdaHandler) validateToken(ctx context.Context) {
+	h.tokenCheckedAt.Store(time.Now().UnixNano())
+	token, err := h.accessToken(ctx)
+	if err != nil {
+		// Every directive retries the exchange, in case Home Assistant was
+		// only unreachable
+		h.logger(ctx).Sugar().Warnf("Could not refresh the access token: %v", err)
+		return
+	}
+	status, err := h.apiStatus(ctx, token)
+	if err != nil {
+		h.logger(ctx).Sugar().Warnf("Could not validate token, Home Assistant unreachable: %v", err)
+		return
+	}
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		h.logger(ctx).Sugar().Errorf("LONG_LIVED_ACCESS_TOKEN was rejected by Home Assistant (status code: %d), create a new token", status)
+		h.tokenRejected.Store(true)
+		return
+	}
+	h.tokenRejected.Store(false)
+	h.logger(ctx).Sugar().Info("LONG_LIVED_ACCESS_TOKEN accepted by Home Assistant")
+}
+
+// tokenStillRejected reports whether the token is in the rejected state,
+// checking it again if the last check is older than tokenRecheckInterval.
+// Only one directive at a time does the check.
+func (h *LambdaHandler) tokenStillRejected(ctx context.Context, now time.Time) bool {
+	if !h.tokenRejected.Load() {
+		return false
+	}
+	last := h.tokenCheckedAt.Load()
+	if now.UnixNano()-last >= int64(tokenRecheckInterval) && h.tokenCheckedAt.CompareAndSwap(last, now.UnixNano()) {
+		h.validateToken(ctx)
+	}
+	return h.tokenRejected.Load()
+}
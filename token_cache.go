@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Tokens this close to expiry are treated as expired, so one is never sent
+// that lapses in flight.
+const tokenExpiryMargin = 30 * time.Second
+
+// tokenCache keeps short-lived tokens obtained by an exchange, such as
+// refreshed access tokens, in memory and under dir with their expiry. /tmp
+// outlives the process within an execution environment, so a restarted
+// runtime skips the exchange too; only a cold start has to go back to the
+// durable store. Without a dir tokens are only kept in memory.
+type tokenCache struct {
+	dir string
+	// durable, when set, is consulted on a local miss and keeps every
+	// exchanged token, see STATE_STORE
+	durable TokenStore
+
+	mu      sync.Mutex
+	entries map[string]cachedToken
+}
+
+type cachedToken struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+func newTokenCache(dir string) *tokenCache {
+	return &tokenCache{dir: dir, entries: make(map[string]cachedToken)}
+}
+
+func (c *tokenCache) path(key string) string {
+	return filepath.Join(c.dir, tokenHash(key)+".json")
+}
+
+// get returns the token cached under key unless it is about to expire.
+func (c *tokenCache) get(key string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	token, ok := c.entries[key]
+	if !ok && c.dir != "" {
+		data, err := os.ReadFile(c.path(key))
+		if err != nil || json.Unmarshal(data, &token) != nil {
+			return "", false
+		}
+		c.entries[key] = token
+	} else if !ok {
+		return "", false
+	}
+	if now.Add(tokenExpiryMargin).After(token.Expires) {
+		return "", false
+	}
+	return token.Value, true
+}
+
+// put caches a token until expires. Failing to write the file only costs a
+// later exchange, so it is not an error.
+func (c *tokenCache) put(key, value string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	token := cachedToken{Value: value, Expires: expires}
+	c.entries[key] = token
+	if c.dir == "" {
+		return
+	}
+
+	data, _ := json.Marshal(token)
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(c.dir, "token-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	os.Rename(tmp.Name(), c.path(key))
+}
+
+// fetch returns the cached token for key, or exchanges a new one with
+// exchange and caches it.
+func (c *tokenCache) fetch(ctx context.Context, key string, exchange func(context.Context) (string, time.Time, error)) (string, error) {
+	now := time.Now()
+	if token, ok := c.get(key, now); ok {
+		return token, nil
+	}
+	if c.durable != nil {
+		token, expires, err := c.durable.GetToken(ctx, key)
+		if err == nil && now.Add(tokenExpiryMargin).Before(expires) {
+			c.put(key, token, expires)
+			return token, nil
+		}
+	}
+
+	token, expires, err := exchange(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.put(key, token, expires)
+	if c.durable != nil {
+		// A failed write only costs another exchange on the next cold start
+		c.durable.PutToken(ctx, key, token, expires)
+	}
+	return token, nil
+}
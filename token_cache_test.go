@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test that exchanged tokens survive a new process via the cache directory
+func TestTokenCache(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	exchanges := 0
+	exchange := func(context.Context) (string, time.Time, error) {
+		exchanges++
+		return "short-lived", time.Now().Add(time.Hour), nil
+	}
+
+	cache := newTokenCache(dir)
+	for i := 0; i < 2; i++ {
+		if token, err := cache.fetch(context.Background(), "refresh-token", exchange); err != nil || token != "short-lived" {
+			t.Fatalf("Unexpected token %q (%v)", token, err)
+		}
+	}
+	// A fresh cache, as after a runtime restart, reads the file
+	if token, err := newTokenCache(dir).fetch(context.Background(), "refresh-token", exchange); err != nil || token != "short-lived" {
+		t.Fatalf("Unexpected token %q (%v)", token, err)
+	}
+	if exchanges != 1 {
+		t.Errorf("Expected 1 exchange, got %d", exchanges)
+	}
+
+	cache.put("expiring", "old", time.Now().Add(10*time.Second))
+	if _, ok := cache.get("expiring", time.Now()); ok {
+		t.Error("Expected a token about to expire to be a miss")
+	}
+}
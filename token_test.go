@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateToken(t *testing.T) {
+	t.Parallel()
+	upstream := fakeHomeAssistant("mock-token")
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "mock-token"})
+	handler.validateToken(context.Background())
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Errorf("Expected a valid token to pass, got %v", err)
+	}
+
+	handler = newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "revoked"})
+	handler.validateToken(context.Background())
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != errTokenRejected {
+		t.Errorf("Expected %v, got %v", errTokenRejected, err)
+	}
+}
+
+// Test that a token rejected at startup is checked again and accepted once
+// Home Assistant stops refusing it
+func TestValidateToken_Recheck(t *testing.T) {
+	t.Parallel()
+	hass := fakeHomeAssistant("mock-token")
+	defer hass.Close()
+	var refusing atomic.Bool
+	refusing.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refusing.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		hass.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	handler := newTestHandler(t, Config{BaseURL: upstream.URL, LongLivedToken: "mock-token"})
+	handler.validateToken(context.Background())
+	refusing.Store(false)
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != errTokenRejected {
+		t.Errorf("Expected %v before the recheck interval, got %v", errTokenRejected, err)
+	}
+
+	handler.tokenCheckedAt.Add(-int64(tokenRecheckInterval))
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Errorf("Expected the token to be accepted on recheck, got %v", err)
+	}
+}
+
+// Test that a refresh token is exchanged once and the access token reused
+func TestHandleRequest_RefreshToken(t *testing.T) {
+	t.Parallel()
+	hass := fakeHomeAssistant("short-lived")
+	defer hass.Close()
+	var exchanges atomic.Int32
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/auth/token" {
+			hass.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		exchanges.Add(1)
+		r.ParseForm()
+		if r.Form.Get("refresh_token") != "refresh" || !strings.HasSuffix(r.Form.Get("client_id"), "/") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"short-lived","expires_in":1800,"token_type":"Bearer"}`))
+	}))
+	defer auth.Close()
+
+	handler := newTestHandler(t, Config{BaseURL: auth.URL, RefreshToken: "refresh"})
+	for i := 0; i < 2; i++ {
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+			t.Fatalf("Request %d returned an error: %v", i, err)
+		}
+	}
+	if exchanges.Load() != 1 {
+		t.Errorf("Expected one exchange, got %d", exchanges.Load())
+	}
+
+	handler = newTestHandler(t, Config{BaseURL: auth.URL, RefreshToken: "revoked"})
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != errRefreshRejected {
+		t.Errorf("Expected %v, got %v", errRefreshRejected, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the split percentage is read from AppConfig. The extension
+	// caches it too, so this only bounds how stale the local copy gets.
+	splitRefresh = 30 * time.Second
+	// Directives to the secondary the rollback decision looks at, and how
+	// many of them it needs before deciding.
+	splitWindow     = 20
+	splitMinSamples = 10
+)
+
+// trafficSplit sends a percentage of the directives for BASE_URL to the
+// secondary instance, for a gradual move to new Home Assistant hardware.
+// When more than maxErrors percent of the recent directives to the secondary
+// fail, it rolls back to sending everything to the primary until the
+// percentage is changed.
+type trafficSplit struct {
+	// source returns the configured percentage
+	source    func(ctx context.Context) (int, error)
+	maxErrors int
+
+	mu         sync.Mutex
+	percent    int
+	loaded     time.Time
+	outcomes   []bool
+	rolledBack bool
+}
+
+func newTrafficSplit(cfg Config) *trafficSplit {
+	if cfg.SecondaryBaseURL == "" || (cfg.SplitPercent == 0 && cfg.SplitAppConfig == "") {
+		return nil
+	}
+	source := func(context.Context) (int, error) { return cfg.SplitPercent, nil }
+	if cfg.SplitAppConfig != "" {
+		source = appConfigPercent(cfg.SplitAppConfig)
+	}
+	return &trafficSplit{source: source, maxErrors: cfg.SplitMaxErrors}
+}
+
+// appConfigPercent reads {"percent": N} from the AppConfig Lambda extension,
+// profile given as application/environment/configuration.
+func appConfigPercent(profile string) func(ctx context.Context) (int, error) {
+	parts := strings.SplitN(profile, "/", 3)
+	url := fmt.Sprintf("http://localhost:2772/applications/%s/environments/%s/configurations/%s", parts[0], parts[1], parts[2])
+
+	return func(ctx context.Context) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return 0, fmt.Errorf("appconfig: status code %d: %s", resp.StatusCode, body)
+		}
+		var settings struct {
+			Percent int `json:"percent"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+			return 0, fmt.Errorf("appconfig: %w", err)
+		}
+		// SPLIT_PERCENT is validated at startup, a profile edit is not
+		return min(max(settings.Percent, 0), 100), nil
+	}
+}
+
+// current returns the percentage to send to the secondary, 0 after a
+// rollback. When a reload fails the previous percentage stays in use and the
+// error is returned with it.
+func (s *trafficSplit) current(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	stale := time.Since(s.loaded) >= splitRefresh
+	s.mu.Unlock()
+	var err error
+	if stale {
+		var percent int
+		percent, err = s.source(ctx)
+		s.mu.Lock()
+		if err == nil && percent != s.percent {
+			// A new percentage is a new attempt
+			s.percent = percent
+			s.outcomes = nil
+			s.rolledBack = false
+		}
+		s.loaded = time.Now()
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rolledBack {
+		return 0, err
+	}
+	return s.percent, err
+}
+
+// pick reports whether a directive goes to the secondary.
+func (s *trafficSplit) pick(ctx context.Context) (bool, error) {
+	percent, err := s.current(ctx)
+	return percent > 0 && rand.IntN(100) < percent, err
+}
+
+// observe records the outcome of a directive sent to the secondary and
+// reports whether it triggered a rollback.
+func (s *trafficSplit) observe(healthy bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcomes = append(s.outcomes, healthy)
+	if len(s.outcomes) > splitWindow {
+		s.outcomes = s.outcomes[len(s.outcomes)-splitWindow:]
+	}
+	if s.rolledBack || len(s.outcomes) < splitMinSamples {
+		return false
+	}
+	failures := 0
+	for _, ok := range s.outcomes {
+		if !ok {
+			failures++
+		}
+	}
+	if failures*100 <= s.maxErrors*len(s.outcomes) {
+		return false
+	}
+	s.rolledBack = true
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// Test that a failing secondary is retried on the primary and rolled back
+func TestHandleRequest_TrafficSplitRollback(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:          "http://primary.example",
+		LongLivedToken:   "token",
+		SecondaryBaseURL: "http://secondary.example",
+		SplitPercent:     100,
+		SplitMaxErrors:   20,
+	})
+	calls := map[string]int{}
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		calls[req.URL.Host]++
+		if req.URL.Host == "secondary.example" {
+			return stubResponse(http.StatusBadGateway, ""), nil
+		}
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+
+	for i := 0; i < splitMinSamples+5; i++ {
+		if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+			t.Fatalf("Request %d returned an error: %v", i, err)
+		}
+	}
+	if calls["secondary.example"] != splitMinSamples {
+		t.Errorf("Expected a rollback after %d failures, got %d secondary calls", splitMinSamples, calls["secondary.example"])
+	}
+	if calls["primary.example"] != splitMinSamples+5 {
+		t.Errorf("Expected every directive answered by the primary, got %d calls", calls["primary.example"])
+	}
+}
+
+func TestTrafficSplit_NewPercentageRearms(t *testing.T) {
+	t.Parallel()
+	percent := 0
+	split := &trafficSplit{source: func(context.Context) (int, error) { return percent, nil }, maxErrors: 50}
+	if secondary, _ := split.pick(context.Background()); secondary {
+		t.Error("Expected nothing sent to the secondary at 0%")
+	}
+
+	percent = 100
+	split.rolledBack = true
+	split.loaded = split.loaded.Add(-splitRefresh)
+	if secondary, _ := split.pick(context.Background()); !secondary {
+		t.Error("Expected a new percentage to end the rollback")
+	}
+}
+
+// Test that a directive with side effects the secondary received is not
+// resent to the primary
+func TestHandleRequest_TrafficSplitNotReadOnly(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{
+		BaseURL:          "http://primary.example",
+		LongLivedToken:   "token",
+		SecondaryBaseURL: "http://secondary.example",
+		SplitPercent:     100,
+		SplitMaxErrors:   20,
+	})
+	calls := map[string]int{}
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		calls[req.URL.Host]++
+		if req.URL.Host == "secondary.example" {
+			return stubResponse(http.StatusBadGateway, ""), nil
+		}
+		return stubResponse(http.StatusOK, `{"event":{}}`), nil
+	})
+
+	if _, err := handler.HandleRequest(context.Background(), powerEvent("light#kitchen")); err == nil {
+		t.Error("Expected the secondary's 502")
+	}
+	if calls["primary.example"] != 0 {
+		t.Errorf("Expected TurnOn not to be resent to the primary, got %d calls", calls["primary.example"])
+	}
+}
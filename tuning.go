@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+const (
+	// Share of the Lambda memory size handed to the Go runtime as GOMEMLIMIT,
+	// the rest is headroom for goroutine stacks and non-heap allocations.
+	defaultMemoryLimitPercent = 80
+
+	// Lambda allocates CPU in proportion to memory: one full vCPU at 1769MB,
+	// up to six vCPUs at the 10240MB maximum.
+	memoryMBPerVCPU = 1769
+	maxLambdaVCPUs  = 6
+)
+
+// applyRuntimeTuning sizes the Go runtime to the Lambda function before the
+// tailnet is brought up.
+func applyRuntimeTuning() {
+	memoryMB, _ := strconv.Atoi(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))
+
+	// The sandbox reports the host's CPUs, far more than the function gets
+	if os.Getenv("GOMAXPROCS") == "" {
+		if vcpus := lambdaVCPUs(memoryMB); vcpus > 0 {
+			runtime.GOMAXPROCS(vcpus)
+		}
+	}
+
+	percent := defaultMemoryLimitPercent
+	if v := os.Getenv("MEMORY_LIMIT_PERCENT"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p <= 0 || p > 100 {
+			log.Printf("Ignoring invalid MEMORY_LIMIT_PERCENT %q", v)
+		} else {
+			percent = p
+		}
+	}
+
+	// An explicit GOMEMLIMIT has already been applied by the runtime
+	if os.Getenv("GOMEMLIMIT") == "" {
+		if limit := memoryLimit(memoryMB, percent); limit > 0 {
+			debug.SetMemoryLimit(limit)
+		}
+	}
+
+	if v := os.Getenv("GC_PERCENT"); v != "" {
+		gcPercent, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("Ignoring invalid GC_PERCENT %q", v)
+		} else {
+			debug.SetGCPercent(gcPercent)
+		}
+	}
+}
+
+// lambdaVCPUs returns the number of vCPUs Lambda allocates to a function with
+// memoryMB of memory, or 0 when the size is unknown.
+func lambdaVCPUs(memoryMB int) int {
+	if memoryMB <= 0 {
+		return 0
+	}
+	vcpus := (memoryMB + memoryMBPerVCPU - 1) / memoryMBPerVCPU
+	return min(vcpus, maxLambdaVCPUs)
+}
+
+// memoryLimit returns the soft memory limit in bytes for a function with
+// memoryMB of memory, or 0 when the size is unknown.
+func memoryLimit(memoryMB, percent int) int64 {
+	if memoryMB <= 0 {
+		return 0
+	}
+	return int64(memoryMB) << 20 * int64(percent) / 100
+}
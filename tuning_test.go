@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestMemoryLimit(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		memoryMB int
+		percent  int
+		expected int64
+	}{
+		{memoryMB: 0, percent: 80, expected: 0},
+		{memoryMB: 128, percent: 80, expected: 128 << 20 * 80 / 100},
+		{memoryMB: 1024, percent: 100, expected: 1024 << 20},
+	}
+
+	for _, tt := range tests {
+		if got := memoryLimit(tt.memoryMB, tt.percent); got != tt.expected {
+			t.Errorf("memoryLimit(%d, %d) = %d, expected %d", tt.memoryMB, tt.percent, got, tt.expected)
+		}
+	}
+}
+
+func TestLambdaVCPUs(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		memoryMB int
+		expected int
+	}{
+		{memoryMB: 0, expected: 0},
+		{memoryMB: 128, expected: 1},
+		{memoryMB: 1769, expected: 1},
+		{memoryMB: 1770, expected: 2},
+		{memoryMB: 10240, expected: 6},
+	}
+
+	for _, tt := range tests {
+		if got := lambdaVCPUs(tt.memoryMB); got != tt.expected {
+			t.Errorf("lambdaVCPUs(%d) = %d, expected %d", tt.memoryMB, got, tt.expected)
+		}
+	}
+}
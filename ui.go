@@ -0,0 +1,48 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiResult is what the test console shows for a sent directive.
+type uiResult struct {
+	Response map[string]interface{} `json:"response,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Timing   timingBreakdown        `json:"timing"`
+}
+
+// mountUI serves the directive test console under /ui/.
+func (h *LambdaHandler) mountUI(mux *http.ServeMux) {
+	static, _ := fs.Sub(uiFiles, "ui")
+	mux.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/ui/send", h.serveUISend)
+}
+
+func (h *LambdaHandler) serveUISend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var event map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, timing := withTiming(r.Context())
+	response, err := h.HandleRequest(ctx, event)
+
+	result := uiResult{Response: response, Timing: timing.breakdown()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// upstreamAuth is what an auth layer in front of Home Assistant, such as
+// Authelia or Traefik forward-auth, needs on every request. It is kept as
+// JSON in UPSTREAM_AUTH_SECRET:
+//
+//	{"headers": {"X-Api-Key": "..."}, "username": "...", "password": "..."}
+//
+// Authorization carries the Home Assistant token, so basic-auth credentials
+// are sent as Proxy-Authorization.
+type upstreamAuth struct {
+	Headers  map[string]string `json:"headers"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+}
+
+// loadUpstreamAuth reads UPSTREAM_AUTH_SECRET into the headers added to
+// upstream requests.
+func loadUpstreamAuth(ctx context.Context, spec string) (http.Header, error) {
+	secret, err := openSecret(ctx, "UPSTREAM_AUTH_SECRET", spec)
+	if err != nil {
+		return nil, err
+	}
+	value, err := secret.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parseUpstreamAuth(value)
+}
+
+func parseUpstreamAuth(value string) (http.Header, error) {
+	var auth upstreamAuth
+	if err := json.Unmarshal([]byte(value), &auth); err != nil {
+		return nil, fmt.Errorf("invalid UPSTREAM_AUTH_SECRET: %w", err)
+	}
+	header := make(http.Header)
+	for name, v := range auth.Headers {
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			return nil, fmt.Errorf("invalid UPSTREAM_AUTH_SECRET: Authorization carries the Home Assistant token, use username and password for basic auth")
+		}
+		header.Set(name, v)
+	}
+	if auth.Username != "" {
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(auth.Username, auth.Password)
+		header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	}
+	return header, nil
+}
+
+// headerDoer adds the upstream auth headers to every request.
+type headerDoer struct {
+	next   HTTPDoer
+	header http.Header
+}
+
+func (d headerDoer) Do(req *http.Request) (*http.Response, error) {
+	for name, values := range d.header {
+		req.Header[name] = values
+	}
+	return d.next.Do(req)
+}
+
+func (d headerDoer) CloseIdleConnections() {
+	if closer, ok := d.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (h *LambdaHandler) withUpstreamAuth(client HTTPDoer) HTTPDoer {
+	if len(h.upstreamHeader) == 0 {
+		return client
+	}
+	return headerDoer{next: client, header: h.upstreamHeader}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleRequest_UpstreamAuth(t *testing.T) {
+	t.Parallel()
+	hass := fakeHomeAssistant("mock-token")
+	defer hass.Close()
+	// Stands in for a forward-auth layer in front of Home Assistant
+	forwardAuth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := (&http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth()
+		if r.Header.Get("X-Api-Key") != "key" || user != "alexa" || pass != "pw" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		hass.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer forwardAuth.Close()
+
+	header, err := parseUpstreamAuth(`{"headers": {"x-api-key": "key"}, "username": "alexa", "password": "pw"}`)
+	if err != nil {
+		t.Fatalf("parseUpstreamAuth returned an error: %v", err)
+	}
+	handler := newTestHandler(t, Config{BaseURL: forwardAuth.URL, LongLivedToken: "mock-token"})
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err == nil {
+		t.Error("Expected the auth layer to reject a request without its headers")
+	}
+	handler.upstreamHeader = header
+	if _, err := handler.HandleRequest(context.Background(), discoveryEvent()); err != nil {
+		t.Errorf("Request returned an error: %v", err)
+	}
+
+	if _, err := parseUpstreamAuth(`{"headers": {"authorization": "Basic x"}}`); err == nil {
+		t.Error("Expected an Authorization header to be refused")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Largest webhook body relayed to Home Assistant.
+const maxWebhookBody = 1 << 20
+
+// serveWebhook relays POST /api/webhook/<id> to the same path on Home
+// Assistant, so third-party callbacks can trigger webhook automations
+// without HA being exposed. HA authenticates webhooks by their id alone, so
+// no token is added.
+func (h *LambdaHandler) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/webhook/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fmt.Sprintf("%s/api/webhook/%s", h.BaseURL, id), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := h.httpClient().Do(req)
+	if err != nil {
+		h.logger(r.Context()).Sugar().Warnf("Error relaying webhook: %v", err)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, io.LimitReader(resp.Body, maxWebhookBody))
+}
+
+// serveFunnel publishes only the webhook relay to the internet through
+// Tailscale Funnel, which terminates TLS on the node's ts.net name.
+func (h *LambdaHandler) serveFunnel() error {
+	ln, err := h.TSNetServer.ListenFunnel("tcp", ":443")
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/webhook/", h.serveWebhook)
+	h.Logger.Sugar().Info("Webhook relay published through Funnel")
+	return http.Serve(ln, mux)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeWebhook(t *testing.T) {
+	t.Parallel()
+	handler := newTestHandler(t, Config{BaseURL: "http://hass.example", LongLivedToken: "token"})
+	handler.HTTPClient = doerFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		if req.URL.String() != "http://hass.example/api/webhook/doorbell" || string(body) != `{"ring":true}` {
+			t.Errorf("Unexpected relay %s %s", req.URL, body)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Error("Expected no token on the webhook")
+		}
+		return stubResponse(http.StatusOK, ""), nil
+	})
+	mux := handler.newServeMux("")
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/webhook/doorbell", strings.NewReader(`{"ring":true}`)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/webhook/a/b", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a nested path, got %d", rec.Code)
+	}
+}